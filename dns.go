@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/devel/dnsmapper/storeapi"
 	"github.com/miekg/dns"
 )
 
@@ -65,13 +69,73 @@ func getEdnsSubNet(req *dns.Msg) (enum string, rr *dns.OPT, edns *dns.EDNS0_SUBN
 	return
 }
 
+// whoamiLabel is the name (below the base domain) that answers TXT
+// queries with what we can see of the resolver, for clients that
+// can't do the HTTP half of the test.
+const whoamiLabel = "whoami"
+
+func whoamiTXT(name, ip, ednsIP string) *dns.TXT {
+	txt := []string{"resolver " + ip}
+	if len(ednsIP) > 0 {
+		txt = append(txt, "edns "+ednsIP)
+	}
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Ttl:    0,
+			Rrtype: dns.TypeTXT, Class: dns.ClassINET,
+		},
+		Txt: txt,
+	}
+}
+
+func resolverFingerprint(w dns.ResponseWriter, req *dns.Msg) storeapi.ResolverFingerprint {
+	fp := storeapi.ResolverFingerprint{
+		RD: req.RecursionDesired,
+		CD: req.CheckingDisabled,
+	}
+
+	name := req.Question[0].Name
+	fp.MixedCase = strings.ToLower(name) != name && strings.ToUpper(name) != name
+
+	if opt := req.IsEdns0(); opt != nil {
+		fp.EdnsUDPSize = opt.UDPSize()
+		fp.EdnsDO = opt.Do()
+		for _, o := range opt.Option {
+			switch o.(type) {
+			case *dns.EDNS0_NSID:
+				fp.EdnsNSID = true
+			case *dns.EDNS0_COOKIE:
+				fp.EdnsCookie = true
+			}
+		}
+	}
+
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		fp.Transport = "udp"
+		fp.ServerPort = uint16(addr.Port)
+	case *net.TCPAddr:
+		fp.Transport = "tcp"
+		fp.ServerPort = uint16(addr.Port)
+	}
+
+	return fp
+}
+
 func setupServerFunc() func(dns.ResponseWriter, *dns.Msg) {
 
 	soa := setupSOA()
 	ns := setupNS()
 
-	h := &dns.RR_Header{Ttl: 5, Class: dns.ClassINET, Rrtype: dns.TypeA}
-	a := &dns.A{Hdr: *h, A: net.ParseIP(*flagip)}
+	ip4 := net.ParseIP(*flagip)
+	var ip6 net.IP
+	if len(*flagip6) > 0 {
+		ip6 = net.ParseIP(*flagip6)
+		if ip6 == nil || ip6.To4() != nil {
+			log.Fatalf("Invalid IPv6 address '%s'", *flagip6)
+		}
+	}
 
 	hasACME := false
 	if len(*flagacmedomain) > 0 {
@@ -127,8 +191,35 @@ func setupServerFunc() func(dns.ResponseWriter, *dns.Msg) {
 			return
 		}
 
-		// we only know how to do A records
-		if qtype != dns.TypeA {
+		if uuid == whoamiLabel && qtype == dns.TypeTXT {
+			m.Answer = []dns.RR{whoamiTXT(req.Question[0].Name, ip, ednsIP)}
+			if edns != nil {
+				edns.SourceScope = edns.SourceNetmask
+			}
+			w.WriteMsg(m)
+
+			if *flagwhoamireport {
+				data := &storeapi.ResultV2{
+					NodeID:   *flagnodeid,
+					TestIP:   *flagip,
+					ServerIP: ip,
+					EdnsNet:  ednsIP,
+					DNSTime:  time.Now(),
+					Family:   storeapi.AddressFamily(ip),
+
+					ResolverFingerprint: resolverFingerprint(w, req),
+				}
+				if edns != nil {
+					data.EdnsSourcePrefix = int(edns.SourceNetmask)
+					data.EdnsScopePrefix = int(edns.SourceScope)
+				}
+				queueReport(data)
+			}
+			return
+		}
+
+		// we only know how to do A and (if configured) AAAA records
+		if qtype != dns.TypeA && (qtype != dns.TypeAAAA || ip6 == nil) {
 			m.Ns = []dns.RR{soa}
 			w.WriteMsg(m)
 			return
@@ -142,21 +233,39 @@ func setupServerFunc() func(dns.ResponseWriter, *dns.Msg) {
 		}
 
 		if len(m.Answer) == 0 {
-			a.Header().Name = req.Question[0].Name
-			m.Answer = []dns.RR{a}
+			h := dns.RR_Header{Name: req.Question[0].Name, Class: dns.ClassINET, Rrtype: qtype}
+
+			var rr dns.RR
+			if qtype == dns.TypeAAAA {
+				rr = &dns.AAAA{Hdr: h, AAAA: ip6}
+			} else {
+				rr = &dns.A{Hdr: h, A: ip4}
+			}
+			m.Answer = []dns.RR{rr}
 
 			if uuid == "www" {
 				// we always redirect on 'www' so tell DNS caches
 				// it is good for a little longer and don't store
 				// the session
-				a.Header().Ttl = 120
+				rr.Header().Ttl = uint32(*flagwwwttl)
 			} else {
-				// We expire the session data after 10 seconds, so
-				// encourage DNS caches to come back after 5.
-				a.Header().Ttl = 5
-				setCache(uuid, ip, ednsIP)
+				// We expire the session data after -sessionlifetime,
+				// so encourage DNS caches to come back before that.
+				rr.Header().Ttl = uint32(*flagdnsttl)
+				rq := &ResolverQuery{
+					IP:                  ip,
+					EDNS:                ednsIP,
+					Time:                time.Now(),
+					ResolverFingerprint: resolverFingerprint(w, req),
+				}
 				if edns != nil {
 					edns.SourceScope = edns.SourceNetmask
+					rq.EdnsSourcePrefix = int(edns.SourceNetmask)
+					rq.EdnsScopePrefix = int(edns.SourceScope)
+				}
+				err := setCache(uuid, rq)
+				if err != nil {
+					log.Printf("Could not save session: %s", err)
 				}
 			}
 		}
@@ -177,16 +286,21 @@ func setupServerFunc() func(dns.ResponseWriter, *dns.Msg) {
 
 func listenAndServeDNS(ip string, port int) {
 
-	listen := fmt.Sprintf("%s:%d", ip, port)
+	listen := net.JoinHostPort(ip, strconv.Itoa(port))
 
 	prots := []string{"udp", "tcp"}
 
 	for _, prot := range prots {
 		go func(p string) {
 			server := &dns.Server{Addr: listen, Net: p}
+			trackDNSServer(server)
 
 			log.Printf("DNS listen on %s %s", ip, p)
-			if err := server.ListenAndServe(); err != nil {
+			err := server.ListenAndServe()
+			if shuttingDown.Load() {
+				return
+			}
+			if err != nil {
 				log.Fatalf("geodns: failed to setup dns %s %s: %s", ip, p, err)
 			}
 			log.Fatalf("geodns: ListenAndServe unexpectedly returned")
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+type testResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}
+}
+func (w *testResponseWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *testResponseWriter) Close() error                { return nil }
+func (w *testResponseWriter) TsigStatus() error           { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool)         {}
+func (w *testResponseWriter) Hijack()                     {}
+
+func testQuery(t *testing.T, handler dns.HandlerFunc, name string, qtype uint16, resolver string) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(resolver), Port: 5353}}
+	handler(w, req)
+	if w.msg == nil {
+		t.Fatalf("no response for %s", name)
+	}
+	return w.msg
+}
+
+func TestAAAA(t *testing.T) {
+	*flagdomain = "mapper.example.com"
+	*flagip = "192.0.2.1"
+	*flagip6 = ""
+	setup()
+
+	m := testQuery(t, setupServerFunc(), "v4only.mapper.example.com.", dns.TypeAAAA, "198.51.100.1")
+	assert.Len(t, m.Answer, 0, "no AAAA answer without -ip6")
+
+	*flagip6 = "2001:db8::1"
+	defer func() { *flagip6 = "" }()
+	handler := setupServerFunc()
+
+	m = testQuery(t, handler, "abcdef.mapper.example.com.", dns.TypeAAAA, "2001:db8:53::1")
+	if assert.Len(t, m.Answer, 1) {
+		aaaa, ok := m.Answer[0].(*dns.AAAA)
+		if assert.True(t, ok, "answer is AAAA") {
+			assert.Equal(t, "2001:db8::1", aaaa.AAAA.String())
+			assert.Equal(t, uint32(5), aaaa.Hdr.Ttl)
+		}
+	}
+
+	session, ok := getCache("abcdef")
+	if assert.True(t, ok, "session stored for AAAA query") {
+		assert.Equal(t, "2001:db8:53::1", session.Resolvers[0].IP)
+	}
+
+	m = testQuery(t, handler, "abcdef.mapper.example.com.", dns.TypeA, "198.51.100.1")
+	if assert.Len(t, m.Answer, 1) {
+		assert.Equal(t, "192.0.2.1", m.Answer[0].(*dns.A).A.String())
+	}
+}
+
+func TestWhoami(t *testing.T) {
+	*flagdomain = "mapper.example.com"
+	setup()
+	handler := setupServerFunc()
+
+	req := new(dns.Msg)
+	req.SetQuestion("whoami.mapper.example.com.", dns.TypeTXT)
+	opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("203.0.113.0").To4(),
+	})
+	req.Extra = append(req.Extra, opt)
+
+	w := &testResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 5353}}
+	handler(w, req)
+
+	if assert.Len(t, w.msg.Answer, 1) {
+		txt, ok := w.msg.Answer[0].(*dns.TXT)
+		if assert.True(t, ok, "answer is TXT") {
+			assert.Equal(t, []string{"resolver 198.51.100.1", "edns 203.0.113.0/24"}, txt.Txt)
+		}
+	}
+}
+
+func TestResolverFingerprint(t *testing.T) {
+	*flagdomain = "mapper.example.com"
+	setup()
+	handler := setupServerFunc()
+
+	req := new(dns.Msg)
+	req.SetQuestion("FpTeSt.mapper.example.com.", dns.TypeA)
+	req.CheckingDisabled = true
+	req.SetEdns0(1232, true)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0123456789abcdef"})
+
+	w := &testResponseWriter{remote: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 41000}}
+	handler(w, req)
+
+	session, ok := getCache("fptest")
+	if !assert.True(t, ok, "session stored") {
+		return
+	}
+	fp := session.Resolvers[0].ResolverFingerprint
+	assert.Equal(t, uint16(1232), fp.EdnsUDPSize)
+	assert.True(t, fp.EdnsDO)
+	assert.True(t, fp.EdnsCookie)
+	assert.False(t, fp.EdnsNSID)
+	assert.True(t, fp.RD)
+	assert.True(t, fp.CD)
+	assert.True(t, fp.MixedCase)
+	assert.Equal(t, uint16(41000), fp.ServerPort)
+	assert.Equal(t, "tcp", fp.Transport)
+}
+
+func TestMultipleResolvers(t *testing.T) {
+	*flagdomain = "mapper.example.com"
+	setup()
+	handler := setupServerFunc()
+
+	for _, ip := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.1"} {
+		testQuery(t, handler, "multi.mapper.example.com.", dns.TypeA, ip)
+	}
+
+	session, ok := getCache("multi")
+	if !assert.True(t, ok, "session stored") {
+		return
+	}
+	if assert.Len(t, session.Resolvers, 2) {
+		assert.Equal(t, "198.51.100.1", session.Resolvers[0].IP)
+		assert.Equal(t, "198.51.100.2", session.Resolvers[1].IP)
+	}
+}
+
+func TestDNSMetrics(t *testing.T) {
+	*flagdomain = "mapper.example.com"
+	setup()
+	handler := instrumentDNS(setupServerFunc())
+
+	counter := dnsQueries.WithLabelValues("A", "NOERROR", "udp")
+	before := testutil.ToFloat64(counter)
+
+	testQuery(t, handler, "metrics.mapper.example.com.", dns.TypeA, "198.51.100.1")
+
+	assert.Equal(t, before+1, testutil.ToFloat64(counter))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"os"
@@ -8,9 +9,11 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/devel/dnsmapper/storeapi"
-	lru "github.com/hashicorp/golang-lru"
 	"github.com/miekg/dns"
 )
 
@@ -20,6 +23,7 @@ var VERSION = "2.9.4"
 var (
 	flagdomain     = flag.String("domain", "example.com", "base domain for the dnsmapper")
 	flagip         = flag.String("ip", "127.0.0.1", "set the IP address")
+	flagip6        = flag.String("ip6", "", "set the IPv6 address (optional)")
 	flagdnsport    = flag.Int("dnsport", 53, "Set the DNS port")
 	flaghttpport   = flag.Int("httpport", 80, "Set the HTTP port")
 	flaghttpsport  = flag.Int("httpsport", 443, "Set the HTTP/TLS port")
@@ -28,18 +32,46 @@ var (
 
 	flagacmedomain = flag.String("acmedomain", "", "Domain to cname _acme-challenge.${domain} to")
 
-	flagreporthost = flag.String("reporthost", "", "Hostname for results host")
+	flagreport          = flag.String("report", "", "Where to report results; comma separated list of 'http', 'stdout' and 'file:<path>' (default 'http' with -reporthost)")
+	flagreportfilesize  = flag.Int("reportfilesize", 100, "Rotate report files at this size (MB, 0 to not rotate)")
+	flagreporthost      = flag.String("reporthost", "", "Hostname for results host")
+	flagreportbatch     = flag.Int("reportbatch", 50, "Maximum results per request to the results host (1 to not use the batch API, at most 1000)")
+	flagreportbatchwait = flag.Duration("reportbatchwait", time.Second, "Maximum time to wait for a batch of results to fill up")
+	flagreportkeyid     = flag.String("reportkeyid", "", "Key ID for signing requests to the results host")
+	flagreportsecret    = flag.String("reportsecretfile", "", "File with the shared secret for signing requests to the results host")
+	flagreporthttps     = flag.Bool("reporthttps", false, "Use HTTPS for the results host")
+	flagreportca        = flag.String("reportca", "", "CA certificate(s) for verifying the results host (implies -reporthttps)")
+	flagreportcert      = flag.String("reportcert", "", "Client certificate for the results host (implies -reporthttps)")
+	flagreportkey       = flag.String("reportkey", "", "Client certificate key for the results host")
+
+	flagmetricslisten = flag.String("metricslisten", "", "Listen on this ip:port for /metrics (optional)")
+
+	flagspooldir    = flag.String("spooldir", "", "Directory to spool results to when the results host is unavailable (optional)")
+	flagspoolsize   = flag.Int("spoolsize", 100, "Maximum size of the spool (MB)")
+	flagspoolmaxage = flag.Duration("spoolmaxage", 24*time.Hour, "Drop spooled results older than this")
+	flagspoolrate   = flag.Int("spoolrate", 50, "Maximum results per second replayed from the spool")
+
+	flagshutdowntimeout = flag.Duration("shutdowntimeout", 10*time.Second, "How long to wait for requests and the report queue when stopping")
+	flagmemprofile      = flag.String("memprofile", "", "Write a heap profile to this file when stopping (optional)")
+
+	flagnodeid = flag.String("nodeid", "", "Node ID reported with the results (default the hostname)")
+
+	flagwhoamireport = flag.Bool("whoamireport", false, "Report resolver/EDNS data from whoami TXT queries")
 
 	flagPrimaryNs = flag.String("ns", "ns.example.com", "nameserver names (comma separated)")
+
+	flagsessionstore    = flag.String("sessionstore", "memory", "Session store; 'memory' or redis://[:password@]host[:port][/db] to share sessions between nodes")
+	flagsessions        = flag.Int("sessions", 20000, "Number of sessions kept by the in-memory session store")
+	flagsessionlifetime = flag.Duration("sessionlifetime", 10*time.Second, "How long a client has to make the HTTP request after the DNS request")
+	flagdnsttl          = flag.Int("dnsttl", 5, "TTL (seconds) for test answers; should be shorter than -sessionlifetime")
+	flagwwwttl          = flag.Int("wwwttl", 120, "TTL (seconds) for the 'www' answer")
 )
 
-type logChannel chan *storeapi.RequestData
+type logChannel chan *storeapi.ResultV2
 
 var baseLength int
 var primaryNsList []string
 
-var cache *lru.Cache
-
 var ch logChannel
 
 func getUUIDFromDomain(name string) string {
@@ -56,23 +88,43 @@ func setup() {
 
 	primaryNsList = strings.Split(*flagPrimaryNs, ",")
 
-	log.Println("Listening for requests to", *flagdomain)
-}
+	if len(*flagnodeid) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Printf("Could not get hostname for the node ID: %s", err)
+		}
+		*flagnodeid = hostname
+	}
 
-func init() {
-	ch = make(logChannel, posterCount*20)
+	if *flagdnsttl < 0 {
+		log.Fatalf("-dnsttl can't be negative")
+	}
+	if *flagwwwttl < 0 {
+		log.Fatalf("-wwwttl can't be negative")
+	}
 
-	os.Setenv("PGSSLMODE", "disable")
+	if time.Duration(*flagdnsttl)*time.Second >= *flagsessionlifetime {
+		log.Printf("DNS TTL (%ds) is not shorter than the session lifetime (%s)",
+			*flagdnsttl, *flagsessionlifetime)
+	}
+
+	if sessions != nil {
+		sessions.Close()
+	}
 
-	// Setup a cache to support X DNS requests per time-period
-	// per server where time-period is how long the client
-	// gets to come back with http after doing the DNS request.
 	var err error
-	cache, err = lru.New(20000)
+	sessions, err = newSessionStore(*flagsessionstore, *flagsessions, *flagsessionlifetime)
 	if err != nil {
-		log.Fatalf("Could not setup lru cache: %s", err)
+		log.Fatalf("Could not setup session store: %s", err)
 	}
 
+	log.Println("Listening for requests to", *flagdomain)
+}
+
+func init() {
+	ch = make(logChannel, posterCount*20)
+
+	os.Setenv("PGSSLMODE", "disable")
 }
 
 func main() {
@@ -80,33 +132,106 @@ func main() {
 
 	flag.Parse()
 
-	runtime.MemProfileRate = 1
+	if len(*flagmemprofile) > 0 {
+		runtime.MemProfileRate = 1
+	}
 
 	setup()
 
-	dns.HandleFunc(*flagdomain, setupServerFunc())
+	dns.HandleFunc(*flagdomain, instrumentDNS(setupServerFunc()))
+
+	if *flagreportbatch > maxReportBatch {
+		log.Fatalf("-reportbatch can be at most %d", maxReportBatch)
+	}
+
+	if len(*flagreportsecret) > 0 {
+		if len(*flagreportkeyid) == 0 {
+			log.Fatalf("-reportsecretfile requires -reportkeyid")
+		}
+		var err error
+		reportSecret, err = loadReportSecret(*flagreportsecret)
+		if err != nil {
+			log.Fatalf("Could not load report secret: %s", err)
+		}
+	}
+
+	if reportHTTPS() {
+		if err := setupReportTLS(); err != nil {
+			log.Fatalf("Could not setup TLS for the results host: %s", err)
+		}
+	}
 
+	reportSpec := *flagreport
+	if len(reportSpec) == 0 && len(*flagreporthost) > 0 {
+		reportSpec = "http"
+	}
+	reporter, err := newReporter(reportSpec)
+	if err != nil {
+		log.Fatalf("Could not setup reporting: %s", err)
+	}
+
+	posterCtx, stopPosters := context.WithCancel(context.Background())
+	abortCtx, abortPosters := context.WithCancel(context.Background())
+	posters := &sync.WaitGroup{}
 	for i := 0; i < posterCount; i++ {
-		go reportPoster(ch)
+		posters.Add(1)
+		go func() {
+			defer posters.Done()
+			reportPoster(posterCtx, abortCtx, ch, reporter)
+		}()
+	}
+
+	// only results for the results host are spooled and replayed
+	if len(*flagspooldir) > 0 && !hasSink(reportSpec, "http") {
+		log.Printf("Not spooling results; -spooldir requires the http reporter")
+	} else if len(*flagspooldir) > 0 {
+		resultSpool, err = newSpool(*flagspooldir, int64(*flagspoolsize)<<20, *flagspoolmaxage)
+		if err != nil {
+			log.Fatalf("Could not setup spool: %s", err)
+		}
+		go resultSpool.replay(posterCtx, reportClient(), *flagspoolrate)
 	}
 
-	go httpHandler(*flagip, *flaghttpport, *flaghttpsport)
+	if len(*flagmetricslisten) > 0 {
+		go metricsListen(*flagmetricslisten)
+	}
+
+	httpHandler(*flagip, *flagip6, *flaghttpport, *flaghttpsport)
 	go listenAndServeDNS(*flagip, *flagdnsport)
+	if len(*flagip6) > 0 {
+		go listenAndServeDNS(*flagip6, *flagdnsport)
+	}
 
 	terminate := make(chan os.Signal, 1)
-	signal.Notify(terminate, os.Interrupt)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
 
-	<-terminate
-	log.Printf("dnsmapper: signal received, stopping")
+	sig := <-terminate
+	log.Printf("dnsmapper: %s received, stopping", sig)
 
-	f, err := os.Create("dnsmapper.pprof")
-	if err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithTimeout(context.Background(), *flagshutdowntimeout)
+	defer cancel()
+
+	shutdownServers(ctx)
+	drainReports(ctx, stopPosters, abortPosters, posters)
+	if reporter != nil {
+		if err := reporter.Close(); err != nil {
+			log.Printf("Could not close reporter: %s", err)
+		}
 	}
-	pprof.WriteHeapProfile(f)
-	err = f.Close()
-	if err != nil {
-		log.Println("Error closing profile:", err)
+	if resultSpool != nil {
+		resultSpool.Close()
+	}
+
+	if len(*flagmemprofile) > 0 {
+		f, err := os.Create(*flagmemprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pprof.WriteHeapProfile(f)
+		err = f.Close()
+		if err != nil {
+			log.Println("Error closing profile:", err)
+		}
 	}
 	log.Println("... exiting.")
 
@@ -7,14 +7,13 @@ import (
 	"encoding/base32"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/devel/dnsmapper/storeapi"
@@ -22,11 +21,19 @@ import (
 )
 
 type ipResponse struct {
-	DNS  string
-	EDNS string
-	HTTP string
+	DNS       string
+	EDNS      string
+	HTTP      string
+	LatencyMS int64
+	// Time is when the resolver queried us and Transport is how
+	// ("udp" or "tcp")
+	Time      time.Time
+	Transport string
 }
 
+// ipResponses has an entry for each resolver that queried the uuid
+type ipResponses []*ipResponse
+
 var (
 	uuidCh    chan string
 	localNets []*net.IPNet
@@ -93,7 +100,7 @@ func remoteIP(xff string) string {
 	return ""
 }
 
-func (resp *ipResponse) JSON() (string, error) {
+func (resp ipResponses) JSON() (string, error) {
 	js, err := json.Marshal(resp)
 	if err != nil {
 		log.Print("JSON ERROR:", err)
@@ -102,7 +109,7 @@ func (resp *ipResponse) JSON() (string, error) {
 	return string(js), err
 }
 
-func responseData(req *http.Request) (*ipResponse, error) {
+func responseData(req *http.Request) (ipResponses, error) {
 
 	ip, _, _ := net.SplitHostPort(req.RemoteAddr)
 	nip := net.ParseIP(ip)
@@ -111,29 +118,60 @@ func responseData(req *http.Request) (*ipResponse, error) {
 		ip = remoteIP(xff)
 	}
 
-	resp := &ipResponse{HTTP: ip, DNS: ""}
-
 	uuid := getUUIDFromDomain(req.Host)
 
-	dns, edns, ok := getCache(uuid)
+	session, ok := getCache(uuid)
 
-	if !ok {
+	if !ok || len(session.Resolvers) == 0 {
 		return nil, errors.New("UUID not found")
 	}
 
-	resp.DNS = dns
-	resp.EDNS = edns
+	testIP := *flagip
+	if cip := net.ParseIP(ip); len(*flagip6) > 0 && cip != nil && cip.To4() == nil {
+		testIP = *flagip6
+	}
+
+	resp := make(ipResponses, 0, len(session.Resolvers))
+
+	now := time.Now()
 
-	data := storeapi.RequestData{
-		TestIP:   *flagip,
-		ServerIP: resp.DNS,
-		ClientIP: resp.HTTP,
-		EdnsNet:  resp.EDNS,
+	scheme := "http"
+	if req.TLS != nil || req.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
 	}
-	select {
-	case ch <- &data:
-	default:
-		log.Println("dropped log data, queue full")
+
+	for _, r := range session.Resolvers {
+		latency := now.Sub(r.Time)
+		dnsHTTPLatency.Observe(latency.Seconds())
+
+		resp = append(resp, &ipResponse{
+			HTTP:      ip,
+			DNS:       r.IP,
+			EDNS:      r.EDNS,
+			LatencyMS: latency.Milliseconds(),
+			Time:      r.Time,
+			Transport: r.Transport,
+		})
+
+		data := storeapi.ResultV2{
+			NodeID:   *flagnodeid,
+			TestIP:   testIP,
+			ServerIP: r.IP,
+			ClientIP: ip,
+			EdnsNet:  r.EDNS,
+
+			EdnsSourcePrefix: r.EdnsSourcePrefix,
+			EdnsScopePrefix:  r.EdnsScopePrefix,
+
+			DNSTime:    r.Time,
+			HTTPTime:   &now,
+			HTTPScheme: scheme,
+			HTTPProto:  req.Proto,
+			Family:     storeapi.AddressFamily(ip),
+
+			ResolverFingerprint: r.ResolverFingerprint,
+		}
+		queueReport(&data)
 	}
 
 	return resp, nil
@@ -194,7 +232,7 @@ func mainServer(w http.ResponseWriter, req *http.Request) {
 			return
 		case "/ip":
 			w.WriteHeader(200)
-			w.Write([]byte(resp.HTTP))
+			w.Write([]byte(resp[0].HTTP))
 			return
 		}
 
@@ -278,7 +316,7 @@ func mainServer(w http.ResponseWriter, req *http.Request) {
 
 func httpListen(h http.Handler, ip string, port int, tlsconfig *tls.Config) error {
 
-	listen := fmt.Sprintf("%s:%d", ip, port)
+	listen := net.JoinHostPort(ip, strconv.Itoa(port))
 	srv := &http.Server{
 		Handler:      h,
 		Addr:         listen,
@@ -286,6 +324,8 @@ func httpListen(h http.Handler, ip string, port int, tlsconfig *tls.Config) erro
 		ReadTimeout:  10 * time.Second,
 		TLSConfig:    tlsconfig,
 	}
+	trackHTTPServer(srv)
+
 	if tlsconfig != nil {
 		log.Printf("HTTPS listen on %s", listen)
 		return srv.ListenAndServeTLS(
@@ -298,7 +338,7 @@ func httpListen(h http.Handler, ip string, port int, tlsconfig *tls.Config) erro
 	return srv.ListenAndServe()
 }
 
-func httpHandler(listenIP string, listenHTTPPort, listenHTTPSPort int) {
+func httpHandler(listenIP, listenIP6 string, listenHTTPPort, listenHTTPSPort int) {
 
 	http.HandleFunc("/", mainServer)
 
@@ -316,6 +356,9 @@ func httpHandler(listenIP string, listenHTTPPort, listenHTTPSPort int) {
 		}
 
 		IPs := []string{listenIP}
+		if len(listenIP6) > 0 {
+			IPs = append(IPs, listenIP6)
+		}
 
 		// we have some sort of proxy, so listen on localhost
 		if listenHTTPSPort != 443 {
@@ -329,7 +372,7 @@ func httpHandler(listenIP string, listenHTTPPort, listenHTTPSPort int) {
 			log.Printf("listenIP TLS: %q", listenIP)
 			go func() {
 				err := httpListen(h, listenIP, listenHTTPSPort, tlsconfig)
-				if err != nil {
+				if err != nil && err != http.ErrServerClosed {
 					log.Fatalf("https error %s:%d: %s", listenIP, listenHTTPSPort, err)
 				}
 			}()
@@ -338,6 +381,9 @@ func httpHandler(listenIP string, listenHTTPPort, listenHTTPSPort int) {
 	}
 
 	IPs := []string{listenIP}
+	if len(listenIP6) > 0 {
+		IPs = append(IPs, listenIP6)
+	}
 	if listenHTTPSPort != 80 {
 		if listenIP != "127.0.0.1" {
 			IPs = append(IPs, "127.0.0.1")
@@ -348,17 +394,11 @@ func httpHandler(listenIP string, listenHTTPPort, listenHTTPSPort int) {
 		listenIP := ip
 		go func() {
 			err := httpListen(h, listenIP, listenHTTPPort, nil)
-			if err != nil {
+			if err != nil && err != http.ErrServerClosed {
 				log.Fatalf("http error %s:%d: %s", listenIP, listenHTTPPort, err)
 			}
 		}()
 	}
-
-	// maybe later we can be smarter; now we just wait forever or until something
-	// "fatals" out
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	wg.Wait()
 }
 
 func localNet(ip net.IP) bool {
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResponseData(t *testing.T) {
+	*flagdomain = "mapper.example.com"
+	setup()
+
+	dnsTime := time.Now().Add(-250 * time.Millisecond)
+	tcpTime := dnsTime.Add(-10 * time.Millisecond)
+	setCache("latency", &ResolverQuery{IP: "192.0.2.1", Time: dnsTime,
+		ResolverFingerprint: storeapi.ResolverFingerprint{Transport: "udp"}})
+	setCache("latency", &ResolverQuery{IP: "192.0.2.2", EDNS: "198.51.100.0/24", Time: tcpTime,
+		ResolverFingerprint: storeapi.ResolverFingerprint{Transport: "tcp"}})
+
+	req := httptest.NewRequest("GET", "http://latency.mapper.example.com/json", nil)
+	req.RemoteAddr = "198.51.100.7:43210"
+
+	resp, err := responseData(req)
+	if !assert.NoError(t, err) || !assert.Len(t, resp, 2) {
+		return
+	}
+
+	assert.Equal(t, "198.51.100.7", resp[0].HTTP)
+	assert.Equal(t, "192.0.2.2", resp[1].DNS)
+	assert.Equal(t, "198.51.100.0/24", resp[1].EDNS)
+	assert.GreaterOrEqual(t, resp[0].LatencyMS, int64(250))
+	assert.True(t, dnsTime.Equal(resp[0].Time))
+	assert.Equal(t, "udp", resp[0].Transport)
+	assert.True(t, tcpTime.Equal(resp[1].Time))
+	assert.Equal(t, "tcp", resp[1].Transport)
+
+	for range resp {
+		data := <-ch
+		assert.Equal(t, "198.51.100.7", data.ClientIP)
+		assert.GreaterOrEqual(t, data.LatencyMS(), int64(250))
+		assert.Equal(t, "http", data.HTTPScheme)
+		assert.Equal(t, "HTTP/1.1", data.HTTPProto)
+		assert.Equal(t, storeapi.FamilyIPv4, data.Family)
+		assert.Equal(t, *flagnodeid, data.NodeID)
+	}
+}
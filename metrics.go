@@ -0,0 +1,183 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	dnsQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_dns_queries_total",
+			Help: "DNS queries by query type, response code and transport",
+		},
+		[]string{"qtype", "rcode", "transport"},
+	)
+
+	dnsEcsQueries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_dns_ecs_queries_total",
+			Help: "DNS queries with an EDNS client subnet option, by address family",
+		},
+		[]string{"family"},
+	)
+
+	dnsHTTPLatency = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "dnsmapper_dns_http_latency_seconds",
+			Help:    "Time from the DNS query to the HTTP request for the session",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+	)
+
+	reportDrops = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_report_dropped_total",
+			Help: "Results dropped because the report queue was full",
+		},
+	)
+
+	reportPosts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_report_posts_total",
+			Help: "Results posted to the store, by result",
+		},
+		[]string{"result"},
+	)
+
+	reportRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_report_rejected_total",
+			Help: "Results the store rejected as invalid; these aren't retried",
+		},
+	)
+
+	spoolBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dnsmapper_spool_bytes",
+			Help: "Size of the results spooled on disk",
+		},
+	)
+
+	spoolWritten = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_spool_written_total",
+			Help: "Results written to the spool",
+		},
+	)
+
+	spoolReplayed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_spool_replayed_total",
+			Help: "Spooled results sent to the store",
+		},
+	)
+
+	spoolDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "dnsmapper_spool_dropped_total",
+			Help: "Spooled results dropped, by reason",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		dnsQueries,
+		dnsEcsQueries,
+		dnsHTTPLatency,
+		reportDrops,
+		reportPosts,
+		reportRejected,
+		spoolBytes,
+		spoolWritten,
+		spoolReplayed,
+		spoolDropped,
+
+		prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name: "dnsmapper_report_queue_length",
+				Help: "Results waiting to be posted to the store",
+			},
+			func() float64 { return float64(len(ch)) },
+		),
+	)
+
+	sessionCounter := func(name, help string, get func(SessionStats) uint64) prometheus.Collector {
+		return prometheus.NewCounterFunc(
+			prometheus.CounterOpts{Name: name, Help: help},
+			func() float64 { return float64(get(sessionStats())) },
+		)
+	}
+
+	prometheus.MustRegister(
+		sessionCounter("dnsmapper_session_hits_total", "HTTP requests with a DNS session",
+			func(s SessionStats) uint64 { return s.Hits }),
+		sessionCounter("dnsmapper_session_misses_total", "HTTP requests without a DNS session",
+			func(s SessionStats) uint64 { return s.Misses }),
+		sessionCounter("dnsmapper_session_evictions_total", "Sessions removed from the full in-memory cache",
+			func(s SessionStats) uint64 { return s.Evictions }),
+		sessionCounter("dnsmapper_session_expired_total", "Sessions expired from the in-memory cache",
+			func(s SessionStats) uint64 { return s.Expired }),
+	)
+}
+
+// metricsResponseWriter remembers the response code for the metrics
+type metricsResponseWriter struct {
+	dns.ResponseWriter
+	rcode int
+}
+
+func (w *metricsResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.rcode = m.Rcode
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func instrumentDNS(h dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, req *dns.Msg) {
+		mw := &metricsResponseWriter{ResponseWriter: w, rcode: -1}
+		h(mw, req)
+
+		qtype := "none"
+		if len(req.Question) > 0 {
+			qtype = dns.Type(req.Question[0].Qtype).String()
+		}
+
+		rcode := "none"
+		if mw.rcode >= 0 {
+			rcode = dns.RcodeToString[mw.rcode]
+		}
+
+		transport := "udp"
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			transport = "tcp"
+		}
+
+		dnsQueries.WithLabelValues(qtype, rcode, transport).Inc()
+
+		if _, _, edns := getEdnsSubNet(req); edns != nil {
+			family := "ipv4"
+			if edns.Family == 2 {
+				family = "ipv6"
+			}
+			dnsEcsQueries.WithLabelValues(family).Inc()
+		}
+	}
+}
+
+func metricsListen(listen string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("Metrics listen on %s", listen)
+	err := http.ListenAndServe(listen, mux)
+	if err != nil {
+		log.Fatalf("metrics listen error %s: %s", listen, err)
+	}
+}
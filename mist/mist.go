@@ -11,13 +11,13 @@ import (
 	"github.com/ant0ine/go-json-rest/rest"
 
 	"github.com/devel/dnsmapper/mist/public"
-	"github.com/devel/dnsmapper/storeapi"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/devel/dnsmapper/storage"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
 	listen = flag.String("listen", "", "Listen on this ip:port for the HTTP API")
+	dbSpec = flag.String("db", "postgres", "Database; 'postgres' or sqlite:<path>")
 	dbuser = flag.String("dbuser", "ask", "Postgres user name")
 	dbpass = flag.String("dbpass", "", "Postgres password")
 	dbhost = flag.String("dbhost", "localhost", "Postgres host name")
@@ -26,13 +26,11 @@ var (
 )
 
 var (
-	db        *sqlx.DB
+	db        storage.Storage
 	localNets []*net.IPNet
 )
 
 func init() {
-	flag.Parse()
-
 	pn := []string{"10.0.0.0/8", "192.168.0.0/16"}
 	for _, p := range pn {
 		_, ipnet, err := net.ParseCIDR(p)
@@ -44,6 +42,7 @@ func init() {
 }
 
 func main() {
+	flag.Parse()
 	startHTTP(*listen)
 }
 
@@ -74,6 +73,8 @@ func buildMux() *http.ServeMux {
 
 	mux.Handle("/api/v1/", http.StripPrefix("/api/v1", api.MakeHandler()))
 
+	mux.Handle("/metrics", promhttp.Handler())
+
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
 		w.WriteHeader(200)
 		w.Write([]byte("ok\n"))
@@ -114,11 +115,11 @@ func myIPHandler(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	ips := []storeapi.LogData{}
-	err := db.Select(&ips, "SELECT * FROM ips where client_ip = $1 order by last_seen desc", ip.String())
+	ips, err := db.ClientResults(ip.String())
 	if err != nil {
 		log.Printf("query err: %s", err)
 		http.Error(w.(http.ResponseWriter), "db error", 500)
+		return
 	}
 
 	w.Header().Set("Cache-Control", "private, must-revalidate, max-age=0")
@@ -128,12 +129,11 @@ func myIPHandler(w rest.ResponseWriter, r *rest.Request) {
 
 func dbConnect() error {
 	var err error
-	db, err = sqlx.Connect("postgres", fmt.Sprintf("user=%s host=%s password=%s", *dbuser, *dbhost, *dbpass))
+	db, err = storage.OpenSpec(*dbSpec,
+		fmt.Sprintf("user=%s host=%s password=%s search_path=dnsmapper,public", *dbuser, *dbhost, *dbpass))
 	if err != nil {
 		return err
 	}
-	db.Exec("SET search_path TO dnsmapper,public")
-	db.SetMaxOpenConns(50)
 	return db.Ping()
 }
 
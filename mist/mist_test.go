@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/devel/dnsmapper/storage"
 	"github.com/devel/dnsmapper/storeapi"
 	"github.com/stretchr/testify/assert"
 )
@@ -18,6 +20,35 @@ type jsResponse struct {
 
 func TestAPI(t *testing.T) {
 
+	var err error
+	db, err = storage.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("Could not open database: %s", err)
+	}
+	defer func() {
+		db.Close()
+		db = nil
+	}()
+
+	now := time.Now().UTC()
+	lat, lon := 59.3247, 18.056
+	err = db.Store(&storeapi.LogData{
+		ClientIP:             "127.0.0.1",
+		ServerIP:             "192.0.2.53",
+		EdnsNet:              "192.0.2.53",
+		ClientCC:             "SE",
+		ClientCity:           "Stockholm",
+		ClientLat:            &lat,
+		ClientLon:            &lon,
+		ClientAccuracyRadius: 20,
+		ClientASOrg:          "Example AB",
+		GeoIPCityEpoch:       1700000000,
+		LastSeen:             &now,
+	})
+	if err != nil {
+		t.Fatalf("Could not store result: %s", err)
+	}
+
 	srv := httptest.NewServer(buildMux())
 	uri := srv.URL + "/api/v1/myip"
 
@@ -45,4 +76,15 @@ func TestAPI(t *testing.T) {
 		t.Errorf("Error parsing response: %s", err)
 	}
 
+	if assert.Len(t, ips, 1) {
+		ip := ips[0]
+		assert.Equal(t, "Stockholm", ip.ClientCity)
+		if assert.NotNil(t, ip.ClientLat) {
+			assert.Equal(t, lat, *ip.ClientLat)
+		}
+		assert.Equal(t, uint16(20), ip.ClientAccuracyRadius)
+		assert.Equal(t, "Example AB", ip.ClientASOrg)
+		assert.Equal(t, uint(1700000000), ip.GeoIPCityEpoch)
+	}
+
 }
@@ -2,13 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
 )
 
 var client *http.Client
 
+// maxReportBatch is the most results the store accepts in one request
+const maxReportBatch = 1000
+
+// reportSecret is the shared secret (from -reportsecretfile) for
+// signing requests to the results host
+var reportSecret []byte
+
 const posterCount = 10
 
 func init() {
@@ -19,52 +34,282 @@ func init() {
 	client = &http.Client{Transport: tr}
 }
 
-func reportPoster(ch logChannel) {
-	var active bool
+// reportHTTPS is true when the results host should be reached over
+// HTTPS
+func reportHTTPS() bool {
+	return *flagreporthttps || len(*flagreportca) > 0 || len(*flagreportcert) > 0
+}
 
-	url := "http://" + *flagreporthost + "/api/v1/store-result"
+// setupReportTLS configures the client for the CA and client
+// certificate options for the results host
+func setupReportTLS() error {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
 
-	if len(*flagreporthost) > 0 {
-		active = true
+	if len(*flagreportca) > 0 {
+		pem, err := os.ReadFile(*flagreportca)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", *flagreportca)
+		}
+		tlsConfig.RootCAs = pool
 	}
 
-	var js []byte
-	var err error
+	if len(*flagreportcert) > 0 {
+		cert, err := tls.LoadX509KeyPair(*flagreportcert, *flagreportkey)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+
+	return nil
+}
+
+// reportPoster sends results from the channel to the reporter until
+// the context is cancelled; then it sends what's left in the channel
+// and returns. If abort is cancelled while doing that, the results
+// it has taken but not sent are spooled instead. Results are sent in
+// batches of up to -reportbatch, waiting at most -reportbatchwait for
+// a batch to fill up.
+func reportPoster(ctx, abort context.Context, ch logChannel, reporter Reporter) {
+	batchSize := *flagreportbatch
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	batch := make([]*storeapi.ResultV2, 0, batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if reporter == nil {
+			log.Println("report poster not active")
+		} else if err := reporter.Report(batch); err != nil {
+			log.Printf("Could not report results: %s", err)
+		}
+
+		batch = batch[:0]
+	}
+
+	add := func(data *storeapi.ResultV2) {
+		batch = append(batch, data)
+		if len(batch) >= batchSize {
+			flush()
+		}
+	}
+
+	ticker := time.NewTicker(*flagreportbatchwait)
+	defer ticker.Stop()
 
 	for {
 		select {
 		case data := <-ch:
-			// log.Printf("got log data: '%#v'", data)
-
-			if !active {
-				log.Println("report poster not active")
-				continue
+			add(data)
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				if abort.Err() != nil {
+					spoolResults(batch)
+					return
+				}
+				select {
+				case data := <-ch:
+					add(data)
+				default:
+					flush()
+					return
+				}
 			}
+		}
+	}
+}
 
-			js, err = data.JSON()
-			if err != nil {
-				log.Println("Could not encode JSON: ", err)
-				continue
-			}
-			reader := bytes.NewReader(js)
-			req, err := http.NewRequest("POST", url, reader)
-			if err != nil {
-				log.Printf("could not setup POST request: %s", err)
-				continue
-			}
-			req.Header.Set("Content-Type", "application/json")
+// spoolResults writes results that couldn't be reported when stopping
+// to the spool (if configured)
+func spoolResults(results []*storeapi.ResultV2) {
+	if len(results) == 0 {
+		return
+	}
+	if resultSpool == nil {
+		log.Printf("shutdown deadline reached, %d results not reported", len(results))
+		return
+	}
+	n := 0
+	for _, data := range results {
+		if err := resultSpool.Add(data); err != nil {
+			log.Printf("Could not spool data: %s", err)
+			continue
+		}
+		n++
+	}
+	log.Printf("shutdown deadline reached, spooled %d results", n)
+}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("Error posting data: %s", err)
-				continue
-			}
-			resp.Body.Close()
+// httpReporter posts results to the store on the results host,
+// spooling them (if configured) when that fails
+type httpReporter struct {
+	// single posts each result by itself to the old API
+	single bool
+}
+
+func (r *httpReporter) Report(batch []*storeapi.ResultV2) error {
+	c := reportClient()
 
-			if resp.StatusCode < 200 || resp.StatusCode > 299 {
-				log.Printf("Unhappy response: %d\n", resp.StatusCode)
-				time.Sleep(200 * time.Millisecond) // Slow down a tiny bit when we have errors
+	var err error
+	if r.single {
+		for _, data := range batch {
+			if perr := postResult(c, data); perr != nil {
+				err = perr
+				if rejected(perr, 1) {
+					continue
+				}
+				r.spool(data)
 			}
 		}
+		return err
+	}
+
+	err = postResults(c, batch)
+	if err != nil && !rejected(err, len(batch)) {
+		for _, data := range batch {
+			r.spool(data)
+		}
+	}
+	return err
+}
+
+func (r *httpReporter) spool(data *storeapi.ResultV2) {
+	if resultSpool == nil {
+		return
+	}
+	if err := resultSpool.Add(data); err != nil {
+		log.Printf("Could not spool data: %s", err)
+	}
+}
+
+func (r *httpReporter) Close() error {
+	return nil
+}
+
+// loadReportSecret reads the shared secret for signing reports
+func loadReportSecret(path string) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := bytes.TrimSpace(buf)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("no secret in %s", path)
+	}
+	return secret, nil
+}
+
+func reportBaseURL() string {
+	if reportHTTPS() {
+		return "https://" + *flagreporthost
+	}
+	return "http://" + *flagreporthost
+}
+
+// reportClient returns a client for the results host, signing
+// requests if a report key is configured
+func reportClient() *storeapi.Client {
+	c := storeapi.NewClient(reportBaseURL())
+	c.HTTPClient = client
+	if len(reportSecret) > 0 {
+		c.KeyID = *flagreportkeyid
+		c.Secret = reportSecret
+	}
+	return c
+}
+
+// queueReport sends the result to the report posters. If the queue
+// is full the result is spooled to disk (if configured) or dropped.
+func queueReport(data *storeapi.ResultV2) {
+	select {
+	case ch <- data:
+		return
+	default:
+	}
+
+	if resultSpool != nil {
+		err := resultSpool.Add(data)
+		if err == nil {
+			return
+		}
+		log.Printf("Could not spool data: %s", err)
+	}
+
+	reportDrops.Inc()
+	log.Println("dropped log data, queue full")
+}
+
+// logPostError logs and counts a failed post of n results
+func logPostError(err error, n int) {
+	reportPosts.WithLabelValues("error").Add(float64(n))
+
+	var statusErr *storeapi.StatusError
+	if errors.As(err, &statusErr) {
+		log.Printf("Unhappy response: %s", statusErr)
+		time.Sleep(200 * time.Millisecond) // Slow down a tiny bit when we have errors
+		return
+	}
+	log.Printf("Error posting data: %s", err)
+}
+
+// rejected returns true (and counts the n results) if the store
+// refused the results themselves as invalid; sending them again won't
+// help, so they aren't spooled or retried. Other client errors (a bad
+// signature or certificate, a batch that's too large) are a problem
+// with this node's setup and the results are kept.
+func rejected(err error, n int) bool {
+	var statusErr *storeapi.StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		reportRejected.Add(float64(n))
+		return true
 	}
+	return false
+}
+
+func postResult(c *storeapi.Client, data *storeapi.ResultV2) error {
+	err := c.StoreResult(context.Background(), data)
+	if err != nil {
+		logPostError(err, 1)
+		return err
+	}
+	reportPosts.WithLabelValues("success").Inc()
+	return nil
+}
+
+// postResults sends the batch with the batch API. Errors for
+// individual results are logged; an error is returned if the batch
+// as a whole failed.
+func postResults(c *storeapi.Client, batch []*storeapi.ResultV2) error {
+	result, err := c.StoreResults(context.Background(), batch)
+	if err != nil {
+		logPostError(err, len(batch))
+		return err
+	}
+
+	for _, e := range result.Errors {
+		if e.Index >= 0 && e.Index < len(batch) {
+			log.Printf("Result %+v not stored: %s", batch[e.Index], e.Error)
+		}
+	}
+	reportPosts.WithLabelValues("error").Add(float64(len(result.Errors)))
+	reportPosts.WithLabelValues("success").Add(float64(result.Stored))
+
+	return nil
 }
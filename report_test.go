@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportPosterDrain(t *testing.T) {
+	var posted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/api/v2/store-results", req.URL.Path)
+		body, _ := io.ReadAll(req.Body)
+		assert.Equal(t, "node1", req.Header.Get(storeapi.HeaderKeyID))
+		assert.NoError(t, storeapi.CheckSignature(req, body, []byte("secret")))
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if !assert.NoError(t, err) {
+			return
+		}
+		dec := json.NewDecoder(gz)
+		n := 0
+		for dec.More() {
+			data := storeapi.ResultV2{}
+			assert.NoError(t, dec.Decode(&data))
+			n++
+		}
+		posted.Add(int32(n))
+		json.NewEncoder(w).Encode(storeapi.BatchResult{Stored: n})
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	*flagreporthost = u.Host
+	*flagreportkeyid = "node1"
+	reportSecret = []byte("secret")
+	defer func() {
+		*flagreporthost = ""
+		*flagreportkeyid = ""
+		reportSecret = nil
+	}()
+
+	queue := make(logChannel, 10)
+	for i := 0; i < 5; i++ {
+		queue <- &storeapi.ResultV2{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}
+	}
+
+	// stopped before it starts; it should still post what's queued
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reportPoster(ctx, context.Background(), queue, &httpReporter{})
+	}()
+	wg.Wait()
+
+	assert.Equal(t, int32(5), posted.Load())
+	assert.Len(t, queue, 0)
+}
+
+func TestRejected(t *testing.T) {
+	for code, drop := range map[int]bool{400: true, 422: true, 401: false, 403: false, 413: false, 429: false, 503: false} {
+		assert.Equal(t, drop, rejected(&storeapi.StatusError{StatusCode: code}, 1), "status %d", code)
+	}
+	assert.False(t, rejected(io.ErrUnexpectedEOF, 1), "network error")
+}
+
+// recordingReporter keeps the batches it was given
+type recordingReporter struct {
+	mu      sync.Mutex
+	batches [][]*storeapi.ResultV2
+}
+
+func (r *recordingReporter) Report(batch []*storeapi.ResultV2) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, append([]*storeapi.ResultV2{}, batch...))
+	return nil
+}
+
+func (r *recordingReporter) Close() error { return nil }
+
+func TestReportPosterAbort(t *testing.T) {
+	sp, err := newSpool(t.TempDir(), spoolSegmentSize, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpool: %s", err)
+	}
+	resultSpool = sp
+	defer func(wait time.Duration) {
+		resultSpool = nil
+		*flagreportbatchwait = wait
+	}(*flagreportbatchwait)
+	*flagreportbatchwait = time.Hour
+
+	queue := make(logChannel, 10)
+	for i := 0; i < 3; i++ {
+		queue <- &storeapi.ResultV2{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	abort, abortPoster := context.WithCancel(context.Background())
+	reporter := &recordingReporter{}
+
+	done := make(chan struct{})
+	go func() {
+		reportPoster(ctx, abort, queue, reporter)
+		close(done)
+	}()
+
+	// the results wait in the poster for the batch to fill up
+	for len(queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	abortPoster()
+	stop()
+	<-done
+
+	assert.Empty(t, reporter.batches)
+
+	name := sp.next()
+	if assert.NotEmpty(t, name, "results spooled") {
+		buf, err := os.ReadFile(name)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, bytes.Count(buf, []byte{'\n'}))
+	}
+}
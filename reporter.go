@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+)
+
+// Reporter sends batches of results somewhere; it's called from
+// several report posters at once.
+type Reporter interface {
+	Report(batch []*storeapi.ResultV2) error
+	Close() error
+}
+
+// newReporter returns the reporter for the comma separated list of
+// sinks in spec; "http" (posting to -reporthost), "stdout" and
+// "file:<path>" for NDJSON files. Several sinks get all the results.
+func newReporter(spec string) (Reporter, error) {
+	var reporters multiReporter
+
+	for _, sink := range strings.Split(spec, ",") {
+		sink = strings.TrimSpace(sink)
+
+		switch {
+		case sink == "":
+			continue
+		case sink == "http":
+			if len(*flagreporthost) == 0 {
+				return nil, errors.New("the http reporter requires -reporthost")
+			}
+			reporters = append(reporters, &httpReporter{single: *flagreportbatch == 1})
+		case sink == "stdout":
+			reporters = append(reporters, newWriterReporter(os.Stdout))
+		case strings.HasPrefix(sink, "file:"):
+			fr, err := newFileReporter(strings.TrimPrefix(sink, "file:"), int64(*flagreportfilesize)<<20)
+			if err != nil {
+				reporters.Close()
+				return nil, err
+			}
+			reporters = append(reporters, fr)
+		default:
+			reporters.Close()
+			return nil, fmt.Errorf("unknown reporter '%s'", sink)
+		}
+	}
+
+	switch len(reporters) {
+	case 0:
+		return nil, nil
+	case 1:
+		return reporters[0], nil
+	}
+	return reporters, nil
+}
+
+// hasSink returns true if the sink is in the newReporter spec
+func hasSink(spec, sink string) bool {
+	for _, s := range strings.Split(spec, ",") {
+		if strings.TrimSpace(s) == sink {
+			return true
+		}
+	}
+	return false
+}
+
+// multiReporter sends each batch to all the reporters
+type multiReporter []Reporter
+
+func (m multiReporter) Report(batch []*storeapi.ResultV2) error {
+	var errs []error
+	for _, r := range m {
+		if err := r.Report(batch); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multiReporter) Close() error {
+	var errs []error
+	for _, r := range m {
+		if err := r.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func encodeNDJSON(batch []*storeapi.ResultV2) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, data := range batch {
+		if err := enc.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// writerReporter writes the results as NDJSON to a writer (stdout)
+type writerReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newWriterReporter(w io.Writer) *writerReporter {
+	return &writerReporter{w: w}
+}
+
+func (r *writerReporter) Report(batch []*storeapi.ResultV2) error {
+	buf, err := encodeNDJSON(batch)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err = r.w.Write(buf)
+	return err
+}
+
+func (r *writerReporter) Close() error {
+	return nil
+}
+
+// fileReporter appends the results as NDJSON to a file. When the file
+// gets bigger than maxSize it's renamed with a timestamp suffix and a
+// new file is started.
+type fileReporter struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+	closed  bool
+}
+
+func newFileReporter(path string, maxSize int64) (*fileReporter, error) {
+	if len(path) == 0 {
+		return nil, errors.New("missing path for the file reporter")
+	}
+	r := &fileReporter{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *fileReporter) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotate renames the current file and opens a new one; the caller
+// must hold the lock. If the rename fails the file is reopened so
+// later reports are still written.
+func (r *fileReporter) rotate() error {
+	err := r.f.Close()
+	r.f = nil
+	if err != nil {
+		return errors.Join(err, r.open())
+	}
+	rotated := r.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	if err := os.Rename(r.path, rotated); err != nil {
+		return errors.Join(err, r.open())
+	}
+	return r.open()
+}
+
+func (r *fileReporter) Report(batch []*storeapi.ResultV2) error {
+	buf, err := encodeNDJSON(batch)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return errors.New("file reporter is closed")
+	}
+	if r.f == nil {
+		// opening the file failed when rotating it
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(buf)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return fmt.Errorf("could not rotate %s: %s", r.path, err)
+		}
+	}
+
+	n, err := r.f.Write(buf)
+	r.size += int64(n)
+	return err
+}
+
+func (r *fileReporter) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.closed = true
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
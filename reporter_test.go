@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileReporter(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "results.json")
+
+	fr, err := newFileReporter(path, 500)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	stdout := &bytes.Buffer{}
+	r := multiReporter{fr, newWriterReporter(stdout)}
+
+	for i := 0; i < 5; i++ {
+		err := r.Report([]*storeapi.ResultV2{
+			{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1", TestIP: "203.0.113.1"},
+		})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, r.Close())
+
+	files, err := filepath.Glob(path + "*")
+	assert.NoError(t, err)
+	assert.Greater(t, len(files), 1, "file was rotated")
+
+	count := func(buf []byte) int {
+		n := 0
+		scanner := bufio.NewScanner(bytes.NewReader(buf))
+		for scanner.Scan() {
+			data := storeapi.ResultV2{}
+			assert.NoError(t, json.Unmarshal(scanner.Bytes(), &data))
+			assert.Equal(t, "192.0.2.1", data.ClientIP)
+			n++
+		}
+		return n
+	}
+
+	n := 0
+	for _, file := range files {
+		buf, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, len(buf), 500)
+		n += count(buf)
+	}
+	assert.Equal(t, 5, n)
+	assert.Equal(t, 5, count(stdout.Bytes()))
+
+	assert.Error(t, fr.Report([]*storeapi.ResultV2{{}}), "closed reporter")
+}
+
+func TestFileReporterRotateFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.json")
+
+	fr, err := newFileReporter(path, 100)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer fr.Close()
+
+	batch := []*storeapi.ResultV2{{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1", TestIP: "203.0.113.1"}}
+	assert.NoError(t, fr.Report(batch))
+
+	// the rename fails when the file is gone
+	assert.NoError(t, os.Remove(path))
+	assert.Error(t, fr.Report(batch), "rotation failed")
+
+	assert.NoError(t, fr.Report(batch), "file reopened")
+	buf, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bytes.Count(buf, []byte{'\n'}))
+}
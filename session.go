@@ -1,51 +1,281 @@
 package main
 
 import (
+	"container/list"
 	"fmt"
+	"hash/fnv"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
 )
 
-// Session is what we store temporarily from each DNS requestxxrf
+// maxSessionResolvers limits how many resolvers we remember for
+// one uuid
+const maxSessionResolvers = 16
+
+// sessionShards is how many independently locked parts the
+// in-memory session cache is split into
+const sessionShards = 16
+
+// sessionSweepInterval is how often expired sessions are removed
+// from the in-memory cache
+const sessionSweepInterval = time.Second
+
+// Session is what we store temporarily from the DNS requests for a uuid
 type Session struct {
-	IP     string
-	EDNS   string
-	Expire int64
+	Resolvers []*ResolverQuery
+	Expire    time.Time
+}
+
+// ResolverQuery is a DNS request from one resolver for the session
+type ResolverQuery struct {
+	IP   string
+	EDNS string
+	Time time.Time
+	// EDNS client subnet source and (answered) scope prefix lengths
+	EdnsSourcePrefix int
+	EdnsScopePrefix  int
+	storeapi.ResolverFingerprint
+}
+
+// SessionStore keeps the DNS half of a test until the HTTP request
+// for the uuid comes in (possibly on another node).
+type SessionStore interface {
+	// Add records a DNS query for the uuid
+	Add(uuid string, rq *ResolverQuery) error
+	// Get returns the session for the uuid if it hasn't expired
+	Get(uuid string) (*Session, bool)
+	// Close stops background work and releases connections
+	Close() error
+}
+
+// SessionStats counts session cache activity since startup
+type SessionStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Expired   uint64
+}
+
+var sessions SessionStore
+
+var sessionCounters struct {
+	hits, misses, evictions, expired atomic.Uint64
+}
+
+func sessionStats() SessionStats {
+	return SessionStats{
+		Hits:      sessionCounters.hits.Load(),
+		Misses:    sessionCounters.misses.Load(),
+		Evictions: sessionCounters.evictions.Load(),
+		Expired:   sessionCounters.expired.Load(),
+	}
+}
+
+// newSessionStore returns the store configured with -sessionstore;
+// size is only used for the in-memory store.
+func newSessionStore(spec string, size int, lifetime time.Duration) (SessionStore, error) {
+	if spec == "" || spec == "memory" {
+		return newMemorySessionStore(size, lifetime)
+	}
+	return newRedisSessionStore(spec, lifetime)
+}
+
+// hasResolver returns true if the resolver/EDNS combination already
+// is in the list
+func hasResolver(resolvers []*ResolverQuery, rq *ResolverQuery) bool {
+	for _, r := range resolvers {
+		if r.IP == rq.IP && r.EDNS == rq.EDNS {
+			return true
+		}
+	}
+	return false
+}
+
+func setCache(uuid string, rq *ResolverQuery) error {
+	return sessions.Add(uuid, rq)
+}
+
+func getCache(uuid string) (*Session, bool) {
+	s, ok := sessions.Get(uuid)
+	if ok {
+		sessionCounters.hits.Add(1)
+	} else {
+		sessionCounters.misses.Add(1)
+	}
+	return s, ok
+}
+
+// memorySessionStore keeps sessions in memory on this node. The
+// sessions all have the same lifetime, so each shard keeps them in
+// a list ordered by expiration; the sweeper and evictions when the
+// shard is full take from the front.
+type memorySessionStore struct {
+	shards    [sessionShards]*sessionShard
+	shardSize int
+	lifetime  time.Duration
+	stop      chan struct{}
+}
+
+type sessionShard struct {
+	// mu also serializes updates to a session so concurrent
+	// queries from several resolvers all get added
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+}
+
+type sessionEntry struct {
+	uuid    string
+	session *Session
+}
+
+func newMemorySessionStore(size int, lifetime time.Duration) (*memorySessionStore, error) {
+	if size < sessionShards {
+		return nil, fmt.Errorf("session cache size must be at least %d", sessionShards)
+	}
+	if lifetime <= 0 {
+		return nil, fmt.Errorf("invalid session lifetime %s", lifetime)
+	}
+
+	st := &memorySessionStore{
+		shardSize: size / sessionShards,
+		lifetime:  lifetime,
+		stop:      make(chan struct{}),
+	}
+	for i := range st.shards {
+		st.shards[i] = &sessionShard{
+			items: map[string]*list.Element{},
+			order: list.New(),
+		}
+	}
+
+	go st.sweeper()
+
+	return st, nil
+}
+
+func (st *memorySessionStore) shard(uuid string) *sessionShard {
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	return st.shards[h.Sum32()%sessionShards]
 }
 
-func setCache(uuid, ip, ednsIP string) error {
+func (st *memorySessionStore) Add(uuid string, rq *ResolverQuery) error {
+	sh := st.shard(uuid)
+	now := time.Now()
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	var resolvers []*ResolverQuery
+	e, ok := sh.items[uuid]
+	if ok {
+		if s := e.Value.(*sessionEntry).session; s.Expire.After(now) {
+			resolvers = s.Resolvers
+		}
+	}
+
+	if !hasResolver(resolvers, rq) {
+		// the session is kept as it is so the HTTP request still
+		// finds the resolvers we have
+		if len(resolvers) >= maxSessionResolvers {
+			return fmt.Errorf("%s has too many resolvers, not adding %s", uuid, rq.IP)
+		}
+		// copy the list so readers of the old session aren't affected
+		resolvers = append(resolvers[:len(resolvers):len(resolvers)], rq)
+	}
+
+	if ok {
+		sh.remove(e)
+	}
 
 	session := &Session{
-		Expire: time.Now().Add(10 * time.Second).Unix(),
-		IP:     ip,
-		EDNS:   ednsIP,
+		Expire:    now.Add(st.lifetime),
+		Resolvers: resolvers,
 	}
 
-	ok := cache.Add("dns-"+uuid, session)
-	if !ok {
-		return fmt.Errorf("%s not saved to the cache", uuid)
+	sh.expire(now)
+	for len(sh.items) >= st.shardSize {
+		sh.remove(sh.order.Front())
+		sessionCounters.evictions.Add(1)
 	}
+
+	sh.items[uuid] = sh.order.PushBack(&sessionEntry{uuid: uuid, session: session})
+
 	return nil
 }
 
-func getCache(uuid string) (string, string, bool) {
-	// Use Peek instead of get to just have a "fifo" cache,
-	// where adding an item again moves it to the front of the
-	// list again.
-	get, ok := cache.Peek("dns-" + uuid)
+func (st *memorySessionStore) Get(uuid string) (*Session, bool) {
+	sh := st.shard(uuid)
+
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	e, ok := sh.items[uuid]
 	if !ok {
-		return "", "", false
+		return nil, false
 	}
 
-	s, ok := get.(*Session)
-	if !ok {
-		log.Printf("Session %s wasn't a session type (%T)", uuid, get)
-		return "", "", false
+	s := e.Value.(*sessionEntry).session
+	if !s.Expire.After(time.Now()) {
+		return nil, false
 	}
 
-	if s.Expire < time.Now().Unix() {
-		return "", "", false
+	return s, true
+}
+
+func (sh *sessionShard) remove(e *list.Element) {
+	sh.order.Remove(e)
+	delete(sh.items, e.Value.(*sessionEntry).uuid)
+}
+
+// expire removes the sessions that expired before now; the caller
+// must hold the lock.
+func (sh *sessionShard) expire(now time.Time) {
+	for e := sh.order.Front(); e != nil; e = sh.order.Front() {
+		if e.Value.(*sessionEntry).session.Expire.After(now) {
+			return
+		}
+		sh.remove(e)
+		sessionCounters.expired.Add(1)
 	}
+}
 
-	return s.IP, s.EDNS, true
+func (st *memorySessionStore) sweeper() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	lastLog := time.Now()
+
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-st.stop:
+			return
+		}
+
+		for _, sh := range st.shards {
+			sh.mu.Lock()
+			sh.expire(now)
+			sh.mu.Unlock()
+		}
+
+		if now.Sub(lastLog) >= time.Minute {
+			s := sessionStats()
+			log.Printf("sessions: %d hits, %d misses, %d evictions, %d expired",
+				s.Hits, s.Misses, s.Evictions, s.Expired)
+			lastLog = now
+		}
+	}
+}
+
+// Close stops the sweeper
+func (st *memorySessionStore) Close() error {
+	close(st.stop)
+	return nil
 }
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisTimeout is the deadline for each round-trip to the session
+// server; the DNS and HTTP handlers wait for it.
+const redisTimeout = 500 * time.Millisecond
+
+// redisSessionStore shares sessions between nodes through a server
+// speaking the Redis protocol. Each DNS query is pushed onto a list
+// for the uuid that expires with the session, so queries arriving
+// on different nodes all get recorded.
+type redisSessionStore struct {
+	addr     string
+	password string
+	db       int
+	lifetime time.Duration
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// newRedisSessionStore takes a redis://[:password@]host[:port][/db] URL
+func newRedisSessionStore(spec string, lifetime time.Duration) (*redisSessionStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" {
+		return nil, fmt.Errorf("unsupported session store '%s'", spec)
+	}
+
+	st := &redisSessionStore{
+		addr:     u.Host,
+		lifetime: lifetime,
+		idle:     make(chan *redisConn, 16),
+	}
+
+	if _, _, err := net.SplitHostPort(st.addr); err != nil {
+		st.addr = net.JoinHostPort(st.addr, "6379")
+	}
+
+	if u.User != nil {
+		if p, ok := u.User.Password(); ok {
+			st.password = p
+		} else {
+			st.password = u.User.Username()
+		}
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); len(db) > 0 {
+		st.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis database '%s'", db)
+		}
+	}
+
+	log.Printf("Sharing sessions through redis at %s", st.addr)
+
+	return st, nil
+}
+
+func redisKey(uuid string) string {
+	return "dnsmapper:dns-" + uuid
+}
+
+func (st *redisSessionStore) Add(uuid string, rq *ResolverQuery) error {
+	js, err := json.Marshal(rq)
+	if err != nil {
+		return err
+	}
+
+	c, err := st.conn()
+	if err != nil {
+		return err
+	}
+
+	key := redisKey(uuid)
+	_, err = c.do(
+		[]string{"RPUSH", key, string(js)},
+		// duplicates are filtered when reading, this just
+		// puts a limit on a very busy resolver; the newest
+		// queries are kept so other resolvers still get added
+		[]string{"LTRIM", key, strconv.Itoa(-maxSessionResolvers * 4), "-1"},
+		[]string{"PEXPIRE", key, strconv.FormatInt(st.lifetime.Milliseconds(), 10)},
+	)
+	st.release(c, err)
+
+	return err
+}
+
+func (st *redisSessionStore) Get(uuid string) (*Session, bool) {
+	c, err := st.conn()
+	if err != nil {
+		log.Printf("session store: %s", err)
+		return nil, false
+	}
+
+	key := redisKey(uuid)
+	replies, err := c.do(
+		[]string{"LRANGE", key, "0", "-1"},
+		[]string{"PTTL", key},
+	)
+	st.release(c, err)
+	if err != nil {
+		log.Printf("session store: %s", err)
+		return nil, false
+	}
+
+	list, _ := replies[0].([]interface{})
+	ttl, _ := replies[1].(int64)
+
+	if len(list) == 0 || ttl <= 0 {
+		return nil, false
+	}
+
+	s := &Session{
+		Expire: time.Now().Add(time.Duration(ttl) * time.Millisecond),
+	}
+
+	for _, item := range list {
+		js, ok := item.([]byte)
+		if !ok {
+			continue
+		}
+		rq := &ResolverQuery{}
+		if err := json.Unmarshal(js, rq); err != nil {
+			log.Printf("Session %s has invalid data: %s", uuid, err)
+			continue
+		}
+		if hasResolver(s.Resolvers, rq) {
+			continue
+		}
+		s.Resolvers = append(s.Resolvers, rq)
+		if len(s.Resolvers) >= maxSessionResolvers {
+			break
+		}
+	}
+
+	return s, true
+}
+
+func (st *redisSessionStore) conn() (*redisConn, error) {
+	select {
+	case c := <-st.idle:
+		return c, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", st.addr, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+	if len(st.password) > 0 {
+		setup = append(setup, []string{"AUTH", st.password})
+	}
+	if st.db > 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(st.db)})
+	}
+	if len(setup) > 0 {
+		if _, err := c.do(setup...); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// release returns the connection to the pool unless the error means
+// the connection can't be trusted anymore
+func (st *redisSessionStore) release(c *redisConn, err error) {
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		c.Close()
+		return
+	}
+	select {
+	case st.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+// Close closes the idle connections
+func (st *redisSessionStore) Close() error {
+	for {
+		select {
+		case c := <-st.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// do sends the commands in one pipeline and returns the reply for
+// each. If a command returned an error the other replies are still
+// read; the (first) error is returned.
+func (c *redisConn) do(cmds ...[]string) ([]interface{}, error) {
+	c.SetDeadline(time.Now().Add(redisTimeout))
+
+	var buf bytes.Buffer
+	for _, args := range cmds {
+		fmt.Fprintf(&buf, "*%d\r\n", len(args))
+		for _, a := range args {
+			fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(a), a)
+		}
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var cmdErr error
+	replies := make([]interface{}, len(cmds))
+	for i := range cmds {
+		r, err := c.readReply()
+		if err != nil {
+			if _, ok := err.(redisError); ok {
+				if cmdErr == nil {
+					cmdErr = err
+				}
+				continue
+			}
+			return nil, err
+		}
+		replies[i] = r
+	}
+
+	return replies, cmdErr
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		list := make([]interface{}, n)
+		for i := range list {
+			list[i], err = c.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	}
+
+	return nil, fmt.Errorf("redis: unexpected reply '%s'", line)
+}
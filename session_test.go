@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis implements just enough of the Redis protocol for the
+// session store
+type fakeRedis struct {
+	mu    sync.Mutex
+	lists map[string][]string
+	ln    net.Listener
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	r := &fakeRedis{lists: map[string][]string{}, ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(c)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = br.ReadString('\n')
+			l, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			buf := make([]byte, l+2)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:l])
+		}
+		io.WriteString(c, r.command(args))
+	}
+}
+
+func (r *fakeRedis) command(args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "RPUSH":
+		r.lists[args[1]] = append(r.lists[args[1]], args[2:]...)
+		return fmt.Sprintf(":%d\r\n", len(r.lists[args[1]]))
+	case "LTRIM":
+		l := r.lists[args[1]]
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		if start < 0 {
+			start += len(l)
+		}
+		if stop < 0 {
+			stop += len(l)
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= len(l) {
+			stop = len(l) - 1
+		}
+		if start > stop {
+			delete(r.lists, args[1])
+		} else {
+			r.lists[args[1]] = l[start : stop+1]
+		}
+		return "+OK\r\n"
+	case "PEXPIRE":
+		return "+OK\r\n"
+	case "PTTL":
+		if _, ok := r.lists[args[1]]; !ok {
+			return ":-2\r\n"
+		}
+		return ":5000\r\n"
+	case "LRANGE":
+		l := r.lists[args[1]]
+		s := fmt.Sprintf("*%d\r\n", len(l))
+		for _, v := range l {
+			s += fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+		}
+		return s
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	fr := newFakeRedis(t)
+
+	// two nodes sharing one session server
+	node1, err := newSessionStore("redis://"+fr.ln.Addr().String(), 0, 10*time.Second)
+	if err != nil {
+		t.Fatalf("setup: %s", err)
+	}
+	defer node1.Close()
+	node2, _ := newSessionStore("redis://"+fr.ln.Addr().String(), 0, 10*time.Second)
+	defer node2.Close()
+
+	now := time.Now()
+	assert.NoError(t, node1.Add("abc", &ResolverQuery{IP: "192.0.2.1", Time: now}))
+	assert.NoError(t, node2.Add("abc", &ResolverQuery{IP: "192.0.2.2", EDNS: "198.51.100.0/24", Time: now}))
+	assert.NoError(t, node1.Add("abc", &ResolverQuery{IP: "192.0.2.1", Time: now}))
+
+	s, ok := node2.Get("abc")
+	if assert.True(t, ok) && assert.Len(t, s.Resolvers, 2) {
+		assert.Equal(t, "192.0.2.1", s.Resolvers[0].IP)
+		assert.Equal(t, "198.51.100.0/24", s.Resolvers[1].EDNS)
+	}
+
+	_, ok = node1.Get("missing")
+	assert.False(t, ok)
+
+	// a busy resolver doesn't keep others out of the session
+	for i := 0; i < maxSessionResolvers*8; i++ {
+		assert.NoError(t, node1.Add("busy", &ResolverQuery{IP: "192.0.2.1", Time: now}))
+	}
+	assert.NoError(t, node2.Add("busy", &ResolverQuery{IP: "192.0.2.2", Time: now}))
+
+	s, ok = node1.Get("busy")
+	if assert.True(t, ok) && assert.Len(t, s.Resolvers, 2) {
+		assert.Equal(t, "192.0.2.2", s.Resolvers[1].IP)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	st, err := newMemorySessionStore(sessionShards, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("setup: %s", err)
+	}
+	defer st.Close()
+
+	before := sessionStats()
+
+	// one entry per shard, so adding more evicts the oldest
+	uuids := []string{}
+	for i := 0; len(uuids) < 2; i++ {
+		uuid := fmt.Sprintf("evict%d", i)
+		if st.shard(uuid) == st.shard("evict0") {
+			uuids = append(uuids, uuid)
+		}
+	}
+	assert.NoError(t, st.Add(uuids[0], &ResolverQuery{IP: "192.0.2.1"}))
+	assert.NoError(t, st.Add(uuids[1], &ResolverQuery{IP: "192.0.2.2"}))
+
+	_, ok := st.Get(uuids[0])
+	assert.False(t, ok, "oldest session evicted")
+	_, ok = st.Get(uuids[1])
+	assert.True(t, ok, "newest session kept")
+	assert.Equal(t, before.Evictions+1, sessionStats().Evictions)
+
+	time.Sleep(60 * time.Millisecond)
+	_, ok = st.Get(uuids[1])
+	assert.False(t, ok, "session expired")
+
+	sh := st.shard(uuids[1])
+	sh.mu.Lock()
+	sh.expire(time.Now())
+	assert.Len(t, sh.items, 0, "expired sessions removed")
+	sh.mu.Unlock()
+}
+
+func TestMemorySessionStoreLimit(t *testing.T) {
+	st, err := newMemorySessionStore(sessionShards, 10*time.Second)
+	if err != nil {
+		t.Fatalf("setup: %s", err)
+	}
+	defer st.Close()
+
+	for i := 0; i < maxSessionResolvers; i++ {
+		assert.NoError(t, st.Add("limit", &ResolverQuery{IP: fmt.Sprintf("192.0.2.%d", i)}))
+	}
+	assert.Error(t, st.Add("limit", &ResolverQuery{IP: "198.51.100.1"}))
+	assert.NoError(t, st.Add("limit", &ResolverQuery{IP: "192.0.2.0"}), "known resolver")
+
+	s, ok := st.Get("limit")
+	if assert.True(t, ok, "session kept") {
+		assert.Len(t, s.Resolvers, maxSessionResolvers)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/miekg/dns"
+)
+
+// The servers started by httpListen and listenAndServeDNS so they
+// can be stopped on shutdown.
+var (
+	serversMu   sync.Mutex
+	httpServers []*http.Server
+	dnsServers  []*dns.Server
+
+	shuttingDown atomic.Bool
+)
+
+func trackHTTPServer(srv *http.Server) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	httpServers = append(httpServers, srv)
+}
+
+func trackDNSServer(srv *dns.Server) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	dnsServers = append(dnsServers, srv)
+}
+
+// shutdownServers stops the listeners and waits (until the context
+// is done) for in-flight requests to finish.
+func shutdownServers(ctx context.Context) {
+	shuttingDown.Store(true)
+
+	serversMu.Lock()
+	defer serversMu.Unlock()
+
+	wg := sync.WaitGroup{}
+
+	for _, srv := range httpServers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("Could not shutdown HTTP server %s: %s", srv.Addr, err)
+			}
+		}(srv)
+	}
+
+	for _, srv := range dnsServers {
+		wg.Add(1)
+		go func(srv *dns.Server) {
+			defer wg.Done()
+			if err := srv.ShutdownContext(ctx); err != nil {
+				log.Printf("Could not shutdown DNS server %s %s: %s", srv.Addr, srv.Net, err)
+			}
+		}(srv)
+	}
+
+	wg.Wait()
+}
+
+// drainReports stops the report posters once they've sent what's in
+// the queue. When the context is done first the posters are aborted
+// and the queued results are spooled (if configured); it waits for
+// the posters either way so the reporter can be closed after.
+func drainReports(ctx context.Context, stopPosters, abortPosters context.CancelFunc, posters *sync.WaitGroup) {
+	stopPosters()
+
+	done := make(chan struct{})
+	go func() {
+		posters.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		log.Println("report queue drained")
+		return
+	case <-ctx.Done():
+	}
+
+	abortPosters()
+
+	queued := []*storeapi.ResultV2{}
+queue:
+	for {
+		select {
+		case data := <-ch:
+			queued = append(queued, data)
+		default:
+			break queue
+		}
+	}
+	spoolResults(queued)
+
+	<-done
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+)
+
+const (
+	// spoolSegmentSize and spoolSegmentAge limit how big and old
+	// the file being appended to gets before a new one is started.
+	// Old data is expired and dropped a file at a time.
+	spoolSegmentSize = 1 << 20
+	spoolSegmentAge  = time.Minute
+
+	spoolIdleWait   = 5 * time.Second
+	spoolMinBackoff = time.Second
+	spoolMaxBackoff = 5 * time.Minute
+)
+
+// spool keeps results on disk (as NDJSON files) when they can't be
+// sent to the store right away, because the store is unavailable or
+// the report queue is full, and replays them when the store answers
+// again.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu        sync.Mutex
+	size      int64
+	cur       *os.File
+	curTime   time.Time
+	curSize   int64
+	replaying string
+}
+
+var resultSpool *spool
+
+func newSpool(dir string, maxBytes int64, maxAge time.Duration) (*spool, error) {
+	if maxBytes < spoolSegmentSize {
+		return nil, fmt.Errorf("spool size must be at least %d bytes", spoolSegmentSize)
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &spool{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+	}
+
+	segments, err := sp.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments {
+		if fi, err := os.Stat(name); err == nil {
+			sp.size += fi.Size()
+		}
+	}
+	spoolBytes.Set(float64(sp.size))
+
+	if len(segments) > 0 {
+		log.Printf("spool: %d bytes in %d files to replay from %s", sp.size, len(segments), dir)
+	}
+
+	return sp, nil
+}
+
+// segments returns the spool files, oldest first
+func (sp *spool) segments() ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(sp.dir, "spool-*.ndjson"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func segmentName(dir string, t time.Time) string {
+	return filepath.Join(dir, fmt.Sprintf("spool-%020d.ndjson", t.UnixNano()))
+}
+
+func segmentTime(name string) time.Time {
+	ts := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), "spool-"), ".ndjson")
+	ns, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Add appends the result to the spool, dropping the oldest spooled
+// data if the spool is full.
+func (sp *spool) Add(data *storeapi.ResultV2) error {
+	js, err := data.JSON()
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	now := time.Now()
+
+	if sp.cur != nil && (sp.curSize >= spoolSegmentSize || now.Sub(sp.curTime) >= spoolSegmentAge) {
+		sp.closeCurrent()
+	}
+
+	for sp.size+int64(len(js)) > sp.maxBytes {
+		if !sp.dropOldest("size") {
+			spoolDropped.WithLabelValues("size").Inc()
+			return errors.New("spool is full")
+		}
+	}
+
+	if sp.cur == nil {
+		sp.cur, err = os.OpenFile(segmentName(sp.dir, now), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		sp.curTime = now
+		sp.curSize = 0
+	}
+
+	if sp.size == 0 {
+		log.Printf("spool: spooling results to %s", sp.dir)
+	}
+
+	n, err := sp.cur.Write(js)
+	sp.size += int64(n)
+	sp.curSize += int64(n)
+	spoolBytes.Set(float64(sp.size))
+	if err != nil {
+		return err
+	}
+
+	spoolWritten.Inc()
+	return nil
+}
+
+// Close closes the file being appended to
+func (sp *spool) Close() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.closeCurrent()
+}
+
+func (sp *spool) closeCurrent() {
+	if sp.cur == nil {
+		return
+	}
+	if err := sp.cur.Close(); err != nil {
+		log.Printf("spool: could not close %s: %s", sp.cur.Name(), err)
+	}
+	sp.cur = nil
+}
+
+// remove deletes a spool file; the caller must hold the lock
+func (sp *spool) remove(name string) {
+	if sp.cur != nil && sp.cur.Name() == name {
+		sp.closeCurrent()
+	}
+	if fi, err := os.Stat(name); err == nil {
+		sp.size -= fi.Size()
+	}
+	if err := os.Remove(name); err != nil {
+		log.Printf("spool: could not remove %s: %s", name, err)
+	}
+	spoolBytes.Set(float64(sp.size))
+}
+
+// drop removes a spool file with results that won't be replayed;
+// the caller must hold the lock
+func (sp *spool) drop(name, reason string) {
+	n := 0
+	if buf, err := os.ReadFile(name); err == nil {
+		n = bytes.Count(buf, []byte{'\n'})
+	}
+	log.Printf("spool: dropping %d results in %s (%s)", n, filepath.Base(name), reason)
+	spoolDropped.WithLabelValues(reason).Add(float64(n))
+	sp.remove(name)
+}
+
+// dropOldest drops the oldest file that isn't being replayed; the
+// caller must hold the lock.
+func (sp *spool) dropOldest(reason string) bool {
+	segments, _ := sp.segments()
+	for _, name := range segments {
+		if name == sp.replaying {
+			continue
+		}
+		sp.drop(name, reason)
+		return true
+	}
+	return false
+}
+
+// next returns the oldest spool file ready to be replayed, after
+// dropping the ones older than the age limit.
+func (sp *spool) next() string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.replaying = ""
+
+	segments, _ := sp.segments()
+	for _, name := range segments {
+		if time.Since(segmentTime(name)) > sp.maxAge {
+			sp.drop(name, "age")
+			continue
+		}
+		if sp.cur != nil && sp.cur.Name() == name {
+			if sp.curSize == 0 {
+				continue
+			}
+			// replay what we have now rather than waiting for
+			// the file to fill up
+			sp.closeCurrent()
+		}
+		sp.replaying = name
+		return name
+	}
+
+	return ""
+}
+
+// replay sends the spooled results to the store at up to rate results
+// per second, backing off while the store is unavailable.
+func (sp *spool) replay(ctx context.Context, c *storeapi.Client, rate int) {
+	if rate < 1 {
+		rate = 1
+	}
+	interval := time.Second / time.Duration(rate)
+	backoff := spoolMinBackoff
+
+	for {
+		wait := spoolIdleWait
+
+		if name := sp.next(); len(name) > 0 {
+			n, err := sp.replaySegment(ctx, name, c, interval)
+			if n > 0 {
+				log.Printf("spool: replayed %d results from %s", n, filepath.Base(name))
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				log.Printf("spool: store unavailable (%s), retrying in %s", err, backoff)
+				wait = backoff
+				backoff *= 2
+				if backoff > spoolMaxBackoff {
+					backoff = spoolMaxBackoff
+				}
+			} else {
+				backoff = spoolMinBackoff
+				wait = 0
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// replaySegment posts the results in the file; results the store
+// rejects are dropped. If the store fails the file is rewritten with
+// the results that weren't sent.
+func (sp *spool) replaySegment(ctx context.Context, name string, c *storeapi.Client, interval time.Duration) (int, error) {
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+
+	lines := bytes.SplitAfter(buf, []byte{'\n'})
+	sent := 0
+
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		data := &storeapi.ResultV2{}
+		if err := json.Unmarshal(line, data); err != nil {
+			log.Printf("spool: invalid data in %s: %s", filepath.Base(name), err)
+			spoolDropped.WithLabelValues("invalid").Inc()
+			continue
+		}
+
+		err := postResult(c, data)
+		switch {
+		case err == nil:
+			sent++
+			spoolReplayed.Inc()
+		case rejected(err, 1):
+			spoolDropped.WithLabelValues("rejected").Inc()
+		default:
+			return sent, sp.rewrite(name, bytes.Join(lines[i:], nil), err)
+		}
+
+		if ctx.Err() != nil {
+			return sent, sp.rewrite(name, bytes.Join(lines[i+1:], nil), ctx.Err())
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(interval):
+		}
+	}
+
+	sp.mu.Lock()
+	sp.remove(name)
+	sp.replaying = ""
+	sp.mu.Unlock()
+
+	return sent, nil
+}
+
+// rewrite replaces the file with the results that weren't replayed
+// and returns the error that stopped the replay.
+func (sp *spool) rewrite(name string, remaining []byte, replayErr error) error {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	sp.replaying = ""
+
+	fi, err := os.Stat(name)
+	if err == nil {
+		tmp := name + ".tmp"
+		err = os.WriteFile(tmp, remaining, 0600)
+		if err == nil {
+			err = os.Rename(tmp, name)
+		}
+	}
+	if err != nil {
+		log.Printf("spool: could not update %s: %s", filepath.Base(name), err)
+		return replayErr
+	}
+
+	sp.size -= fi.Size() - int64(len(remaining))
+	spoolBytes.Set(float64(sp.size))
+
+	return replayErr
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpoolReplay(t *testing.T) {
+	var up atomic.Bool
+	var posted atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(503)
+			return
+		}
+		posted.Add(1)
+		w.WriteHeader(204)
+	}))
+	defer srv.Close()
+
+	sp, err := newSpool(t.TempDir(), spoolSegmentSize, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpool: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sp.Add(&storeapi.ResultV2{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}))
+	}
+	size := sp.size
+
+	name := sp.next()
+	if !assert.NotEmpty(t, name) {
+		return
+	}
+	n, err := sp.replaySegment(context.Background(), name, storeapi.NewClient(srv.URL), 0)
+	assert.Error(t, err, "store is down")
+	assert.Equal(t, 0, n)
+	assert.Equal(t, size, sp.size, "nothing removed from the spool")
+
+	up.Store(true)
+
+	name = sp.next()
+	n, err = sp.replaySegment(context.Background(), name, storeapi.NewClient(srv.URL), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, int32(3), posted.Load())
+	assert.Equal(t, int64(0), sp.size)
+	assert.Empty(t, sp.next(), "spool is empty")
+}
+
+func TestSpoolReplayRejected(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(400)
+			return
+		}
+		w.WriteHeader(204)
+	}))
+	defer srv.Close()
+
+	sp, err := newSpool(t.TempDir(), spoolSegmentSize, time.Hour)
+	if err != nil {
+		t.Fatalf("newSpool: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sp.Add(&storeapi.ResultV2{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}))
+	}
+
+	name := sp.next()
+	n, err := sp.replaySegment(context.Background(), name, storeapi.NewClient(srv.URL), 0)
+	assert.NoError(t, err, "rejected result doesn't stop the replay")
+	assert.Equal(t, 2, n)
+	assert.Equal(t, int32(3), requests.Load())
+	assert.Equal(t, int64(0), sp.size)
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	sp, err := newSpool(t.TempDir(), spoolSegmentSize, time.Millisecond)
+	if err != nil {
+		t.Fatalf("newSpool: %s", err)
+	}
+	assert.NoError(t, sp.Add(&storeapi.ResultV2{ClientIP: "192.0.2.1"}))
+
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, sp.next(), "old results dropped")
+	assert.Equal(t, int64(0), sp.size)
+}
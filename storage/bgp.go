@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"github.com/lib/pq"
+)
+
+// BGPPrefix is an announced prefix from the routing table
+type BGPPrefix struct {
+	Prefix    string `db:"prefix"`
+	OriginASN uint   `db:"origin_asn"`
+	ASName    string `db:"as_name"`
+}
+
+const bgpPrefixes = `SELECT prefix, origin_asn, as_name FROM bgp_prefixes`
+
+// ReplaceBGPPrefixes deletes the prefixes and inserts the new ones in
+// one transaction
+func (s *sqlStorage) ReplaceBGPPrefixes(prefixes []BGPPrefix) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM bgp_prefixes`); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(s.bgpPrefix)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, p := range prefixes {
+		if _, err := stmt.Exec(p.Prefix, p.OriginASN, p.ASName); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStorage) BGPPrefixes() ([]BGPPrefix, error) {
+	prefixes := []BGPPrefix{}
+	if err := s.db.Select(&prefixes, bgpPrefixes); err != nil {
+		return nil, err
+	}
+	return prefixes, nil
+}
+
+// ReplaceBGPPrefixes copies the prefixes in; the full routing table is
+// about a million of them.
+func (s *pgStorage) ReplaceBGPPrefixes(prefixes []BGPPrefix) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`TRUNCATE bgp_prefixes`); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("bgp_prefixes", "prefix", "origin_asn", "as_name"))
+	if err != nil {
+		return err
+	}
+	for _, p := range prefixes {
+		if _, err := stmt.Exec(p.Prefix, p.OriginASN, p.ASName); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,441 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// pgUpsert updates the row for the client and server IP (see
+// updateColumns) or inserts a new one. Resolver-only results have a
+// NULL client_ip and a row for each ECS net.
+var pgUpsert = `
+	WITH upsert_data AS (
+		SELECT
+		NULLIF($1, '')::inet AS client_ip,
+		$2::inet AS server_ip,
+		$3::cidr AS edns_net,
+
+		$4::char(2) AS client_cc,
+		$5::char(2) AS client_rc,
+		$6::int AS client_asn,
+
+		$7::char(2) AS server_cc,
+		$8::char(2) AS server_rc,
+		$9::int AS     server_asn,
+
+		$10::char(2) AS edns_cc,
+		$11::char(2) AS edns_rc,
+		$12::int AS     edns_asn,
+
+		$13::inet AS test_ip,
+
+		$14::boolean AS has_edns,
+		$15::timestamp AS last_seen,
+
+		$16::int AS edns_udp_size,
+		$17::boolean AS edns_do,
+		$18::boolean AS edns_nsid,
+		$19::boolean AS edns_cookie,
+		$20::boolean AS rd,
+		$21::boolean AS cd,
+		$22::boolean AS mixed_case,
+		$23::int AS server_port,
+		$24::text AS transport,
+
+		$25::int AS latency_ms,
+
+		$26::text AS submitter,
+
+		$27::text AS node_id,
+		$28::timestamp AS dns_time,
+		$29::timestamp AS http_time,
+		$30::text AS http_scheme,
+		$31::text AS http_proto,
+		$32::text AS family,
+		$33::int AS edns_source_prefix,
+		$34::int AS edns_scope_prefix,
+
+		$35::text AS client_city,
+		$36::double precision AS client_lat,
+		$37::double precision AS client_lon,
+		$38::int AS client_accuracy_radius,
+		$39::text AS client_as_org,
+		$40::text AS server_city,
+		$41::double precision AS server_lat,
+		$42::double precision AS server_lon,
+		$43::int AS server_accuracy_radius,
+		$44::text AS server_as_org,
+		$45::text AS edns_city,
+		$46::double precision AS edns_lat,
+		$47::double precision AS edns_lon,
+		$48::int AS edns_accuracy_radius,
+		$49::text AS edns_as_org,
+		$50::bigint AS geoip_city_epoch,
+		$51::bigint AS geoip_asn_epoch,
+
+		$52::cidr AS client_bgp_prefix,
+		$53::bigint AS client_bgp_asn,
+		$54::cidr AS server_bgp_prefix,
+		$55::bigint AS server_bgp_asn,
+		$56::cidr AS edns_bgp_prefix,
+		$57::bigint AS edns_bgp_asn,
+
+		$58::double precision AS resolver_distance_km,
+		$59::double precision AS edns_distance_km,
+		$60::boolean AS country_mismatch,
+		$61::boolean AS region_mismatch,
+		$62::boolean AS asn_mismatch
+	),
+	update_ips AS (
+		UPDATE ips
+		SET
+			` + updateColumns("ud", "GREATEST") + `,
+			seen_count = ips.seen_count + 1
+
+		FROM upsert_data ud
+		WHERE
+			ips.server_ip = ud.server_ip AND
+			(ips.client_ip = ud.client_ip OR
+			 (ips.client_ip IS NULL AND ud.client_ip IS NULL AND
+			  ips.edns_net IS NOT DISTINCT FROM ud.edns_net))
+		RETURNING ips.*
+	)
+	INSERT INTO
+		ips
+		(client_ip, server_ip, edns_net,
+		 client_cc, client_rc, client_asn,
+		 server_cc, server_rc, server_asn,
+		 edns_cc, edns_rc, edns_asn,
+		 test_ip, has_edns,
+		 first_seen, last_seen,
+		 edns_udp_size, edns_do, edns_nsid, edns_cookie,
+		 rd, cd, mixed_case, server_port, transport,
+		 latency_ms, submitter,
+		 node_id, dns_time, http_time,
+		 http_scheme, http_proto, family,
+		 edns_source_prefix, edns_scope_prefix,
+		 client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+		 server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+		 edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+		 geoip_city_epoch, geoip_asn_epoch,
+		 client_bgp_prefix, client_bgp_asn,
+		 server_bgp_prefix, server_bgp_asn,
+		 edns_bgp_prefix, edns_bgp_asn,
+		 resolver_distance_km, edns_distance_km,
+		 country_mismatch, region_mismatch, asn_mismatch
+		)
+		SELECT
+			client_ip, server_ip, edns_net,
+			client_cc, client_rc, client_asn,
+			server_cc, server_rc, server_asn,
+			edns_cc, edns_rc, edns_asn,
+			test_ip, has_edns,
+			last_seen, last_seen,
+			edns_udp_size, edns_do, edns_nsid, edns_cookie,
+			rd, cd, mixed_case, server_port, transport,
+			latency_ms, submitter,
+			node_id, dns_time, http_time,
+			http_scheme, http_proto, family,
+			edns_source_prefix, edns_scope_prefix,
+			client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+			server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+			edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+			geoip_city_epoch, geoip_asn_epoch,
+			client_bgp_prefix, client_bgp_asn,
+			server_bgp_prefix, server_bgp_asn,
+			edns_bgp_prefix, edns_bgp_asn,
+			resolver_distance_km, edns_distance_km,
+			country_mismatch, region_mismatch, asn_mismatch
+			FROM upsert_data
+			WHERE NOT EXISTS (
+				SELECT 1 FROM update_ips
+			)
+`
+
+const pgObservation = `
+	INSERT INTO observations
+		(observed_at,
+		 client_ip, server_ip, edns_net,
+		 client_cc, client_rc, client_asn,
+		 server_cc, server_rc, server_asn,
+		 edns_cc, edns_rc, edns_asn,
+		 has_edns, test_ip, latency_ms,
+		 edns_source_prefix, edns_scope_prefix,
+		 family, node_id, submitter,
+		 client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+		 server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+		 edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+		 geoip_city_epoch, geoip_asn_epoch,
+		 client_bgp_prefix, client_bgp_asn,
+		 server_bgp_prefix, server_bgp_asn,
+		 edns_bgp_prefix, edns_bgp_asn,
+		 resolver_distance_km, edns_distance_km,
+		 country_mismatch, region_mismatch, asn_mismatch
+		)
+	VALUES
+		($1,
+		 NULLIF($2, '')::inet, $3::inet, $4::cidr,
+		 $5, $6, $7,
+		 $8, $9, $10,
+		 $11, $12, $13,
+		 $14, NULLIF($15, '')::inet, $16,
+		 $17, $18,
+		 $19, $20, $21,
+		 $22, $23, $24, $25, $26,
+		 $27, $28, $29, $30, $31,
+		 $32, $33, $34, $35, $36,
+		 $37, $38,
+		 $39, $40, $41, $42, $43, $44,
+		 $45, $46, $47, $48, $49
+		)
+`
+
+const pgLatency = `
+	INSERT INTO resolver_latency
+		(server_ip, bucket_ms, count, last_seen)
+		VALUES ($1::inet, $2, 1, $3)
+	ON CONFLICT (server_ip, bucket_ms) DO UPDATE
+		SET count = resolver_latency.count + 1,
+		    last_seen = excluded.last_seen
+`
+
+const pgClientResults = `SELECT * FROM ips where client_ip = $1 order by last_seen desc`
+
+const pgBGPPrefix = `INSERT INTO bgp_prefixes (prefix, origin_asn, as_name) VALUES ($1, $2, $3)`
+
+// pgStorage has the observations partitioned by month
+type pgStorage struct {
+	*sqlStorage
+}
+
+func openPostgres(dsn string) (Storage, error) {
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(50)
+
+	return &pgStorage{&sqlStorage{
+		db:            db,
+		upsert:        pgUpsert,
+		observation:   pgObservation,
+		latency:       pgLatency,
+		clientResults: pgClientResults,
+		bgpPrefix:     pgBGPPrefix,
+		farResolvers:  farResolversQuery("host(server_ip)", "$"),
+	}}, nil
+}
+
+// partitionFormat is the name of the observations partition for a
+// month
+const partitionFormat = "observations_y2006m01"
+
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// MaintainHistory creates the partitions for this and next month and
+// drops the partitions that ended more than retention ago. Results
+// for months without a partition are in the default partition; old
+// ones are deleted from there.
+func (s *pgStorage) MaintainHistory(now time.Time, retention time.Duration) error {
+	month := monthStart(now)
+	for _, start := range []time.Time{month, month.AddDate(0, 1, 0)} {
+		_, err := s.db.Exec(fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s PARTITION OF observations FOR VALUES FROM ('%s') TO ('%s')`,
+			start.Format(partitionFormat),
+			start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339),
+		))
+		if err != nil {
+			return fmt.Errorf("could not create partition %s: %s", start.Format(partitionFormat), err)
+		}
+	}
+
+	if retention == 0 {
+		return nil
+	}
+	cutoff := now.Add(-retention).UTC()
+
+	partitions := []string{}
+	err := s.db.Select(&partitions, `
+		SELECT c.relname FROM pg_inherits i
+			JOIN pg_class c ON c.oid = i.inhrelid
+			JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'observations'`)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range partitions {
+		start, err := time.Parse(partitionFormat, name)
+		if err != nil {
+			// the default partition
+			continue
+		}
+		if start.AddDate(0, 1, 0).After(cutoff) {
+			continue
+		}
+		log.Printf("Dropping observations partition %s", name)
+		if _, err := s.db.Exec(`DROP TABLE ` + name); err != nil {
+			return err
+		}
+	}
+
+	_, err = s.db.Exec(`DELETE FROM observations_default WHERE observed_at < $1`, cutoff)
+	return err
+}
+
+// stagingColumns are copied into the staging table by StoreMany, in
+// the order of stagingArgs
+var stagingColumns = append(upsertColumns[:len(upsertColumns):len(upsertColumns)], "latency_bucket")
+
+func nullIfEmpty(s string) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+func stagingArgs(data *storeapi.LogData) []interface{} {
+	args := upsertArgs(data)
+	args[0] = nullIfEmpty(data.ClientIP)
+	args[12] = nullIfEmpty(data.TestIP)
+
+	var bucket interface{}
+	if data.LatencyMS != nil {
+		bucket = latencyBucket(*data.LatencyMS)
+	}
+	return append(args, bucket)
+}
+
+// pgStoreManyQueries run after the batch is copied to ips_staging.
+// ips_latest has the most recent result for each client and server
+// IP (or server IP and ECS net) in the batch with how many there
+// were; the ips rows are updated from it (or inserted) like pgUpsert
+// does for one result.
+var pgStoreManyQueries = func() []string {
+	cols := upsertColumns
+
+	sameIPs := `ips.server_ip = s.server_ip AND
+			(ips.client_ip = s.client_ip OR
+			 (ips.client_ip IS NULL AND s.client_ip IS NULL AND
+			  ips.edns_net IS NOT DISTINCT FROM s.edns_net))`
+
+	// resolver-only results have a row for each ECS net
+	key := `server_ip, client_ip, (CASE WHEN client_ip IS NULL THEN edns_net END)`
+
+	return []string{
+		`CREATE TEMP TABLE ips_latest ON COMMIT DROP AS
+		SELECT DISTINCT ON (` + key + `) *,
+			count(*) OVER w AS seen,
+			min(last_seen) OVER w AS first_seen_batch
+		FROM ips_staging
+		WINDOW w AS (PARTITION BY ` + key + `)
+		ORDER BY ` + key + `, last_seen DESC`,
+
+		`UPDATE ips SET ` + updateColumns("s", "GREATEST") + `,
+			seen_count = ips.seen_count + s.seen
+		FROM ips_latest s
+		WHERE ` + sameIPs,
+
+		`INSERT INTO ips (` + strings.Join(cols, ", ") + `, first_seen, seen_count)
+		SELECT ` + strings.Join(cols, ", ") + `, first_seen_batch, seen
+		FROM ips_latest s
+		WHERE NOT EXISTS (SELECT 1 FROM ips WHERE ` + sameIPs + `)`,
+
+		`INSERT INTO observations
+			(observed_at,
+			 client_ip, server_ip, edns_net,
+			 client_cc, client_rc, client_asn,
+			 server_cc, server_rc, server_asn,
+			 edns_cc, edns_rc, edns_asn,
+			 has_edns, test_ip, latency_ms,
+			 edns_source_prefix, edns_scope_prefix,
+			 family, node_id, submitter,
+			 client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+			 server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+			 edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+			 geoip_city_epoch, geoip_asn_epoch,
+			 client_bgp_prefix, client_bgp_asn,
+			 server_bgp_prefix, server_bgp_asn,
+			 edns_bgp_prefix, edns_bgp_asn,
+			 resolver_distance_km, edns_distance_km,
+			 country_mismatch, region_mismatch, asn_mismatch)
+		SELECT last_seen,
+			client_ip, server_ip, edns_net,
+			client_cc, client_rc, client_asn,
+			server_cc, server_rc, server_asn,
+			edns_cc, edns_rc, edns_asn,
+			has_edns, test_ip, latency_ms,
+			edns_source_prefix, edns_scope_prefix,
+			family, node_id, submitter,
+			client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+			server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+			edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+			geoip_city_epoch, geoip_asn_epoch,
+			client_bgp_prefix, client_bgp_asn,
+			server_bgp_prefix, server_bgp_asn,
+			edns_bgp_prefix, edns_bgp_asn,
+			resolver_distance_km, edns_distance_km,
+			country_mismatch, region_mismatch, asn_mismatch
+		FROM ips_staging`,
+
+		`INSERT INTO resolver_latency (server_ip, bucket_ms, count, last_seen)
+		SELECT server_ip, latency_bucket, count(*), max(last_seen)
+		FROM ips_staging
+		WHERE latency_bucket IS NOT NULL
+		GROUP BY server_ip, latency_bucket
+		ON CONFLICT (server_ip, bucket_ms) DO UPDATE
+			SET count = resolver_latency.count + excluded.count,
+			    last_seen = GREATEST(resolver_latency.last_seen, excluded.last_seen)`,
+	}
+}()
+
+// StoreMany copies the batch into a staging table and merges it into
+// ips, observations and resolver_latency with a few statements.
+func (s *pgStorage) StoreMany(batch []*storeapi.LogData) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TEMP TABLE ips_staging
+		(LIKE ips INCLUDING DEFAULTS, latency_bucket int) ON COMMIT DROP`)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(pq.CopyIn("ips_staging", stagingColumns...))
+	if err != nil {
+		return err
+	}
+	for _, data := range batch {
+		if _, err := stmt.Exec(stagingArgs(data)...); err != nil {
+			stmt.Close()
+			return err
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		stmt.Close()
+		return err
+	}
+	if err := stmt.Close(); err != nil {
+		return err
+	}
+
+	for _, query := range pgStoreManyQueries {
+		if _, err := tx.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ResolverDistance summarizes the observations for a resolver
+type ResolverDistance struct {
+	ServerIP     string `db:"server_ip"`
+	Observations int64  `db:"observations"`
+	Clients      int64  `db:"clients"`
+	// Far is the number of observations with the client further
+	// away than the distance asked for
+	Far               int64   `db:"far"`
+	AvgDistanceKM     float64 `db:"avg_distance_km"`
+	MaxDistanceKM     float64 `db:"max_distance_km"`
+	CountryMismatches int64   `db:"country_mismatches"`
+	RegionMismatches  int64   `db:"region_mismatches"`
+	ASNMismatches     int64   `db:"asn_mismatches"`
+}
+
+// farResolversQuery returns the query for FarResolvers with the
+// expression for the server IP and the placeholder prefix of the
+// database. The arguments are since, far (km), minimum observations
+// and limit.
+func farResolversQuery(serverIP, placeholder string) string {
+	q := fmt.Sprintf(`
+	SELECT
+		%s AS server_ip,
+		count(*) AS observations,
+		count(DISTINCT client_ip) AS clients,
+		sum(CASE WHEN resolver_distance_km > $2 THEN 1 ELSE 0 END) AS far,
+		avg(resolver_distance_km) AS avg_distance_km,
+		max(resolver_distance_km) AS max_distance_km,
+		sum(CASE WHEN country_mismatch THEN 1 ELSE 0 END) AS country_mismatches,
+		sum(CASE WHEN region_mismatch THEN 1 ELSE 0 END) AS region_mismatches,
+		sum(CASE WHEN asn_mismatch THEN 1 ELSE 0 END) AS asn_mismatches
+	FROM observations
+	WHERE observed_at >= $1 AND resolver_distance_km IS NOT NULL
+	GROUP BY server_ip
+	HAVING count(*) >= $3
+	ORDER BY
+		sum(CASE WHEN resolver_distance_km > $2 THEN 1 ELSE 0 END) * 1.0 / count(*) DESC,
+		count(*) DESC
+	LIMIT $4`, serverIP)
+	return strings.ReplaceAll(q, "$", placeholder)
+}
+
+// FarResolvers returns the resolvers with the largest share of their
+// clients further away than farKM in the observations since the time;
+// only resolvers with minObservations (with a known distance) are
+// included.
+func (s *sqlStorage) FarResolvers(since time.Time, farKM float64, minObservations, limit int) ([]ResolverDistance, error) {
+	resolvers := []ResolverDistance{}
+	err := s.db.Select(&resolvers, s.farResolvers, since.UTC(), farKM, minObservations, limit)
+	if err != nil {
+		return nil, err
+	}
+	return resolvers, nil
+}
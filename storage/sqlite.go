@@ -0,0 +1,385 @@
+package storage
+
+import (
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteResolverKey is the edns_net of resolver-only results (and
+// empty for results with a client); ips_key_uidx has a row for each
+// client and server IP and for each server IP and ECS net without a
+// client.
+const sqliteResolverKey = `(CASE WHEN client_ip = '' THEN coalesce(edns_net, '') ELSE '' END)`
+
+// sqliteSchema is applied when the database is opened. It's the
+// Postgres schema (store/table.txt) with text for the inet and cidr
+// columns; client_ip is empty instead of NULL for resolver-only results
+// so the unique index works for the upsert.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS ips (
+    client_ip text not null default '',
+    server_ip text not null,
+    edns_net  text null,
+    client_cc char(2) null,
+    client_rc char(2) null,
+    server_cc char(2) null,
+    server_rc char(2) null,
+    edns_cc char(2) null,
+    edns_rc char(2) null,
+    client_asn int null,
+    server_asn int null,
+    edns_asn int null,
+    has_edns boolean,
+    test_ip  text,
+    first_seen timestamp,
+    last_seen timestamp,
+    edns_udp_size int not null default 0,
+    edns_do boolean not null default false,
+    edns_nsid boolean not null default false,
+    edns_cookie boolean not null default false,
+    rd boolean not null default false,
+    cd boolean not null default false,
+    mixed_case boolean not null default false,
+    server_port int not null default 0,
+    transport text not null default '',
+    latency_ms int null,
+    submitter text not null default '',
+    node_id text not null default '',
+    dns_time timestamp null,
+    http_time timestamp null,
+    http_scheme text not null default '',
+    http_proto text not null default '',
+    family text not null default '',
+    edns_source_prefix int not null default 0,
+    edns_scope_prefix int not null default 0,
+    seen_count bigint not null default 1,
+    client_city text not null default '',
+    client_lat double precision null,
+    client_lon double precision null,
+    client_accuracy_radius int not null default 0,
+    client_as_org text not null default '',
+    server_city text not null default '',
+    server_lat double precision null,
+    server_lon double precision null,
+    server_accuracy_radius int not null default 0,
+    server_as_org text not null default '',
+    edns_city text not null default '',
+    edns_lat double precision null,
+    edns_lon double precision null,
+    edns_accuracy_radius int not null default 0,
+    edns_as_org text not null default '',
+    geoip_city_epoch bigint not null default 0,
+    geoip_asn_epoch bigint not null default 0,
+    client_bgp_prefix text null,
+    client_bgp_asn bigint not null default 0,
+    server_bgp_prefix text null,
+    server_bgp_asn bigint not null default 0,
+    edns_bgp_prefix text null,
+    edns_bgp_asn bigint not null default 0,
+    resolver_distance_km double precision null,
+    edns_distance_km double precision null,
+    country_mismatch boolean not null default false,
+    region_mismatch boolean not null default false,
+    asn_mismatch boolean not null default false
+);
+
+DROP INDEX IF EXISTS ips_ip_uidx;
+CREATE UNIQUE INDEX IF NOT EXISTS ips_key_uidx ON ips (server_ip, client_ip, ` + sqliteResolverKey + `);
+CREATE INDEX IF NOT EXISTS ips_client_idx ON ips (client_ip, server_ip);
+
+CREATE TABLE IF NOT EXISTS resolver_latency (
+    server_ip text not null,
+    bucket_ms int not null,
+    count bigint not null default 0,
+    last_seen timestamp,
+    PRIMARY KEY (server_ip, bucket_ms)
+);
+
+CREATE TABLE IF NOT EXISTS observations (
+    observed_at timestamp not null,
+    client_ip text not null default '',
+    server_ip text not null,
+    edns_net text null,
+    client_cc char(2) null,
+    client_rc char(2) null,
+    client_asn int null,
+    server_cc char(2) null,
+    server_rc char(2) null,
+    server_asn int null,
+    edns_cc char(2) null,
+    edns_rc char(2) null,
+    edns_asn int null,
+    has_edns boolean,
+    test_ip text,
+    latency_ms int null,
+    edns_source_prefix int not null default 0,
+    edns_scope_prefix int not null default 0,
+    family text not null default '',
+    node_id text not null default '',
+    submitter text not null default '',
+    client_city text not null default '',
+    client_lat double precision null,
+    client_lon double precision null,
+    client_accuracy_radius int not null default 0,
+    client_as_org text not null default '',
+    server_city text not null default '',
+    server_lat double precision null,
+    server_lon double precision null,
+    server_accuracy_radius int not null default 0,
+    server_as_org text not null default '',
+    edns_city text not null default '',
+    edns_lat double precision null,
+    edns_lon double precision null,
+    edns_accuracy_radius int not null default 0,
+    edns_as_org text not null default '',
+    geoip_city_epoch bigint not null default 0,
+    geoip_asn_epoch bigint not null default 0,
+    client_bgp_prefix text null,
+    client_bgp_asn bigint not null default 0,
+    server_bgp_prefix text null,
+    server_bgp_asn bigint not null default 0,
+    edns_bgp_prefix text null,
+    edns_bgp_asn bigint not null default 0,
+    resolver_distance_km double precision null,
+    edns_distance_km double precision null,
+    country_mismatch boolean not null default false,
+    region_mismatch boolean not null default false,
+    asn_mismatch boolean not null default false
+);
+
+CREATE INDEX IF NOT EXISTS observations_ip_idx ON observations (server_ip, client_ip, observed_at);
+CREATE INDEX IF NOT EXISTS observations_time_idx ON observations (observed_at);
+
+CREATE TABLE IF NOT EXISTS bgp_prefixes (
+    prefix text primary key,
+    origin_asn bigint not null,
+    as_name text not null default ''
+);
+`
+
+// geoColumns are the GeoIP and BGP details (and what is computed from
+// them) in ips and observations
+var geoColumns = map[string]string{
+	"client_city":            "text not null default ''",
+	"client_lat":             "double precision null",
+	"client_lon":             "double precision null",
+	"client_accuracy_radius": "int not null default 0",
+	"client_as_org":          "text not null default ''",
+	"server_city":            "text not null default ''",
+	"server_lat":             "double precision null",
+	"server_lon":             "double precision null",
+	"server_accuracy_radius": "int not null default 0",
+	"server_as_org":          "text not null default ''",
+	"edns_city":              "text not null default ''",
+	"edns_lat":               "double precision null",
+	"edns_lon":               "double precision null",
+	"edns_accuracy_radius":   "int not null default 0",
+	"edns_as_org":            "text not null default ''",
+	"geoip_city_epoch":       "bigint not null default 0",
+	"geoip_asn_epoch":        "bigint not null default 0",
+	"client_bgp_prefix":      "text null",
+	"client_bgp_asn":         "bigint not null default 0",
+	"server_bgp_prefix":      "text null",
+	"server_bgp_asn":         "bigint not null default 0",
+	"edns_bgp_prefix":        "text null",
+	"edns_bgp_asn":           "bigint not null default 0",
+	"resolver_distance_km":   "double precision null",
+	"edns_distance_km":       "double precision null",
+	"country_mismatch":       "boolean not null default false",
+	"region_mismatch":        "boolean not null default false",
+	"asn_mismatch":           "boolean not null default false",
+}
+
+// sqliteColumns are added to the tables of databases created before
+// they were in sqliteSchema
+var sqliteColumns = map[string]map[string]string{
+	"ips": func() map[string]string {
+		columns := map[string]string{"seen_count": "bigint not null default 1"}
+		for name, def := range geoColumns {
+			columns[name] = def
+		}
+		return columns
+	}(),
+	"observations": geoColumns,
+}
+
+// sqliteUpsert uses the argument numbers of pgUpsert
+var sqliteUpsert = `
+	INSERT INTO ips
+		(client_ip, server_ip, edns_net,
+		 client_cc, client_rc, client_asn,
+		 server_cc, server_rc, server_asn,
+		 edns_cc, edns_rc, edns_asn,
+		 test_ip, has_edns,
+		 first_seen, last_seen,
+		 edns_udp_size, edns_do, edns_nsid, edns_cookie,
+		 rd, cd, mixed_case, server_port, transport,
+		 latency_ms, submitter,
+		 node_id, dns_time, http_time,
+		 http_scheme, http_proto, family,
+		 edns_source_prefix, edns_scope_prefix,
+		 client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+		 server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+		 edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+		 geoip_city_epoch, geoip_asn_epoch,
+		 client_bgp_prefix, client_bgp_asn,
+		 server_bgp_prefix, server_bgp_asn,
+		 edns_bgp_prefix, edns_bgp_asn,
+		 resolver_distance_km, edns_distance_km,
+		 country_mismatch, region_mismatch, asn_mismatch
+		)
+	VALUES
+		(?1, ?2, ?3,
+		 ?4, ?5, ?6,
+		 ?7, ?8, ?9,
+		 ?10, ?11, ?12,
+		 ?13, ?14,
+		 ?15, ?15,
+		 ?16, ?17, ?18, ?19,
+		 ?20, ?21, ?22, ?23, ?24,
+		 ?25, ?26,
+		 ?27, ?28, ?29,
+		 ?30, ?31, ?32,
+		 ?33, ?34,
+		 ?35, ?36, ?37, ?38, ?39,
+		 ?40, ?41, ?42, ?43, ?44,
+		 ?45, ?46, ?47, ?48, ?49,
+		 ?50, ?51,
+		 ?52, ?53, ?54, ?55, ?56, ?57,
+		 ?58, ?59, ?60, ?61, ?62
+		)
+	ON CONFLICT (server_ip, client_ip, ` + sqliteResolverKey + `) DO UPDATE
+	SET
+		` + updateColumns("excluded", "max") + `,
+		seen_count = ips.seen_count + 1
+`
+
+const sqliteObservation = `
+	INSERT INTO observations
+		(observed_at,
+		 client_ip, server_ip, edns_net,
+		 client_cc, client_rc, client_asn,
+		 server_cc, server_rc, server_asn,
+		 edns_cc, edns_rc, edns_asn,
+		 has_edns, test_ip, latency_ms,
+		 edns_source_prefix, edns_scope_prefix,
+		 family, node_id, submitter,
+		 client_city, client_lat, client_lon, client_accuracy_radius, client_as_org,
+		 server_city, server_lat, server_lon, server_accuracy_radius, server_as_org,
+		 edns_city, edns_lat, edns_lon, edns_accuracy_radius, edns_as_org,
+		 geoip_city_epoch, geoip_asn_epoch,
+		 client_bgp_prefix, client_bgp_asn,
+		 server_bgp_prefix, server_bgp_asn,
+		 edns_bgp_prefix, edns_bgp_asn,
+		 resolver_distance_km, edns_distance_km,
+		 country_mismatch, region_mismatch, asn_mismatch
+		)
+	VALUES
+		(?1,
+		 ?2, ?3, ?4,
+		 ?5, ?6, ?7,
+		 ?8, ?9, ?10,
+		 ?11, ?12, ?13,
+		 ?14, ?15, ?16,
+		 ?17, ?18,
+		 ?19, ?20, ?21,
+		 ?22, ?23, ?24, ?25, ?26,
+		 ?27, ?28, ?29, ?30, ?31,
+		 ?32, ?33, ?34, ?35, ?36,
+		 ?37, ?38,
+		 ?39, ?40, ?41, ?42, ?43, ?44,
+		 ?45, ?46, ?47, ?48, ?49
+		)
+`
+
+const sqliteLatency = `
+	INSERT INTO resolver_latency
+		(server_ip, bucket_ms, count, last_seen)
+		VALUES (?1, ?2, 1, ?3)
+	ON CONFLICT (server_ip, bucket_ms) DO UPDATE
+		SET count = resolver_latency.count + 1,
+		    last_seen = excluded.last_seen
+`
+
+const sqliteClientResults = `SELECT * FROM ips where client_ip = ?1 order by last_seen desc`
+
+const sqliteBGPPrefix = `INSERT INTO bgp_prefixes (prefix, origin_asn, as_name) VALUES (?1, ?2, ?3)`
+
+// openSQLite opens (or creates) the database file at path and
+// applies the schema.
+func openSQLite(path string) (Storage, error) {
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		dsn += "?_busy_timeout=5000"
+	}
+
+	db, err := sqlx.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// writes are serialized by SQLite anyway, and an in-memory
+	// database only exists on one connection
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := sqliteAddColumns(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteStorage{&sqlStorage{
+		db:            db,
+		upsert:        sqliteUpsert,
+		observation:   sqliteObservation,
+		latency:       sqliteLatency,
+		clientResults: sqliteClientResults,
+		bgpPrefix:     sqliteBGPPrefix,
+		farResolvers:  farResolversQuery("server_ip", "?"),
+	}}, nil
+}
+
+// sqliteAddColumns adds the missing sqliteColumns to the tables
+func sqliteAddColumns(db *sqlx.DB) error {
+	for table, tableColumns := range sqliteColumns {
+		columns := []struct {
+			Name string `db:"name"`
+		}{}
+		if err := db.Select(&columns, `SELECT name FROM pragma_table_info(?1)`, table); err != nil {
+			return err
+		}
+		existing := map[string]bool{}
+		for _, c := range columns {
+			existing[c.Name] = true
+		}
+
+		for name, def := range tableColumns {
+			if existing[name] {
+				continue
+			}
+			if _, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + name + ` ` + def); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type sqliteStorage struct {
+	*sqlStorage
+}
+
+// MaintainHistory deletes the observations from before the retention
+// period.
+func (s *sqliteStorage) MaintainHistory(now time.Time, retention time.Duration) error {
+	if retention == 0 {
+		return nil
+	}
+	_, err := s.db.Exec(`DELETE FROM observations WHERE observed_at < ?1`, now.Add(-retention).UTC())
+	return err
+}
@@ -0,0 +1,331 @@
+// Package storage keeps the results from the store (and looks them
+// up for mist) in Postgres or SQLite.
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/jmoiron/sqlx"
+)
+
+// Storage is a database with the results
+type Storage interface {
+	// Store adds or updates the result for the client and server IP
+	// and adds it to the observations history
+	Store(data *storeapi.LogData) error
+
+	// StoreBatch stores the results in one transaction. A result
+	// that fails doesn't stop the others; its error is at the same
+	// index in errs. err is set if the batch as a whole failed.
+	StoreBatch(batch []*storeapi.LogData) (errs []error, err error)
+
+	// StoreMany stores the results with as few statements as the
+	// database allows, in one transaction. If it fails none of the
+	// results are stored; use StoreBatch to find the failing ones.
+	StoreMany(batch []*storeapi.LogData) error
+
+	// ClientResults returns the results for the client IP, most
+	// recently seen first
+	ClientResults(clientIP string) ([]storeapi.LogData, error)
+
+	// MaintainHistory prepares the observations table for new
+	// results and removes results observed more than retention ago
+	// (unless retention is 0).
+	MaintainHistory(now time.Time, retention time.Duration) error
+
+	// FarResolvers summarizes the observations since the time by
+	// resolver, those most often further than farKM from their clients
+	// first.
+	FarResolvers(since time.Time, farKM float64, minObservations, limit int) ([]ResolverDistance, error)
+
+	// ReplaceBGPPrefixes replaces the imported BGP prefixes
+	ReplaceBGPPrefixes(prefixes []BGPPrefix) error
+
+	// BGPPrefixes returns the imported BGP prefixes
+	BGPPrefixes() ([]BGPPrefix, error)
+
+	// Ping checks that the database is reachable
+	Ping() error
+
+	Close() error
+}
+
+// Open returns the storage for the driver ("postgres" or "sqlite")
+// and data source name.
+func Open(driver, dsn string) (Storage, error) {
+	switch driver {
+	case "postgres":
+		return openPostgres(dsn)
+	case "sqlite", "sqlite3":
+		return openSQLite(dsn)
+	}
+	return nil, fmt.Errorf("unknown storage driver '%s'", driver)
+}
+
+// OpenSpec is Open for a command line option; "postgres" (using the
+// postgres connection string) or "sqlite:<path>".
+func OpenSpec(spec, postgres string) (Storage, error) {
+	if spec == "postgres" {
+		return Open("postgres", postgres)
+	}
+	if strings.HasPrefix(spec, "sqlite:") {
+		return Open("sqlite", strings.TrimPrefix(spec, "sqlite:"))
+	}
+	return nil, fmt.Errorf("unknown database '%s'; use 'postgres' or 'sqlite:<path>'", spec)
+}
+
+// execer is a *sqlx.DB or a *sqlx.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// sqlStorage has the queries that differ between the databases; the
+// arguments are the same for both.
+type sqlStorage struct {
+	db *sqlx.DB
+
+	// upsert has the LogData fields as arguments in the order of
+	// upsertArgs
+	upsert string
+	// observation has the arguments from observationArgs
+	observation string
+	// latency has the server IP, bucket and time as arguments
+	latency string
+	// clientResults has the client IP as argument
+	clientResults string
+	// bgpPrefix inserts a BGPPrefix; prefix, origin ASN and AS name
+	bgpPrefix string
+	// farResolvers is from farResolversQuery
+	farResolvers string
+}
+
+// upsertColumns are the ips columns in the order of upsertArgs
+var upsertColumns = []string{
+	"client_ip", "server_ip", "edns_net",
+	"client_cc", "client_rc", "client_asn",
+	"server_cc", "server_rc", "server_asn",
+	"edns_cc", "edns_rc", "edns_asn",
+	"test_ip", "has_edns", "last_seen",
+	"edns_udp_size", "edns_do", "edns_nsid", "edns_cookie",
+	"rd", "cd", "mixed_case", "server_port", "transport",
+	"latency_ms", "submitter",
+	"node_id", "dns_time", "http_time",
+	"http_scheme", "http_proto", "family",
+	"edns_source_prefix", "edns_scope_prefix",
+	"client_city", "client_lat", "client_lon", "client_accuracy_radius", "client_as_org",
+	"server_city", "server_lat", "server_lon", "server_accuracy_radius", "server_as_org",
+	"edns_city", "edns_lat", "edns_lon", "edns_accuracy_radius", "edns_as_org",
+	"geoip_city_epoch", "geoip_asn_epoch",
+	"client_bgp_prefix", "client_bgp_asn",
+	"server_bgp_prefix", "server_bgp_asn",
+	"edns_bgp_prefix", "edns_bgp_asn",
+	"resolver_distance_km", "edns_distance_km",
+	"country_mismatch", "region_mismatch", "asn_mismatch",
+}
+
+// updateColumns returns the SET list for updating an ips row from
+// the result in src (a table name or alias). last_seen becomes the
+// latest of the two with the greatest function; the other columns are
+// only updated if the result isn't older than the row, so a replayed
+// result doesn't overwrite newer data.
+func updateColumns(src, greatest string) string {
+	newer := fmt.Sprintf("(ips.last_seen IS NULL OR %s.last_seen >= ips.last_seen)", src)
+
+	var set []string
+	for _, c := range upsertColumns {
+		switch c {
+		case "client_ip", "server_ip":
+		case "last_seen":
+			set = append(set, fmt.Sprintf("last_seen = %s(ips.last_seen, %s.last_seen)", greatest, src))
+		default:
+			set = append(set, fmt.Sprintf("%s = CASE WHEN %s THEN %s.%s ELSE ips.%s END", c, newer, src, c, c))
+		}
+	}
+	return strings.Join(set, ",\n\t\t")
+}
+
+func upsertArgs(data *storeapi.LogData) []interface{} {
+	return []interface{}{
+		data.ClientIP, data.ServerIP, data.EdnsNet,
+		data.ClientCC, data.ClientRC, data.ClientASN,
+		data.ServerCC, data.ServerRC, data.ServerASN,
+		data.EdnsCC, data.EdnsRC, data.EdnsASN,
+		data.TestIP, data.HasEdns, data.LastSeen,
+		data.EdnsUDPSize, data.EdnsDO, data.EdnsNSID, data.EdnsCookie,
+		data.RD, data.CD, data.MixedCase, data.ServerPort, data.Transport,
+		data.LatencyMS, data.Submitter,
+		data.NodeID, data.DNSTime, data.HTTPTime,
+		data.HTTPScheme, data.HTTPProto, data.Family,
+		data.EdnsSourcePrefix, data.EdnsScopePrefix,
+		data.ClientCity, data.ClientLat, data.ClientLon, data.ClientAccuracyRadius, data.ClientASOrg,
+		data.ServerCity, data.ServerLat, data.ServerLon, data.ServerAccuracyRadius, data.ServerASOrg,
+		data.EdnsCity, data.EdnsLat, data.EdnsLon, data.EdnsAccuracyRadius, data.EdnsASOrg,
+		data.GeoIPCityEpoch, data.GeoIPASNEpoch,
+		data.ClientBGPPrefix, data.ClientBGPASN,
+		data.ServerBGPPrefix, data.ServerBGPASN,
+		data.EdnsBGPPrefix, data.EdnsBGPASN,
+		data.ResolverDistanceKM, data.EdnsDistanceKM,
+		data.CountryMismatch, data.RegionMismatch, data.ASNMismatch,
+	}
+}
+
+func observationArgs(data *storeapi.LogData) []interface{} {
+	return []interface{}{
+		data.LastSeen,
+		data.ClientIP, data.ServerIP, data.EdnsNet,
+		data.ClientCC, data.ClientRC, data.ClientASN,
+		data.ServerCC, data.ServerRC, data.ServerASN,
+		data.EdnsCC, data.EdnsRC, data.EdnsASN,
+		data.HasEdns, data.TestIP, data.LatencyMS,
+		data.EdnsSourcePrefix, data.EdnsScopePrefix,
+		data.Family, data.NodeID, data.Submitter,
+		data.ClientCity, data.ClientLat, data.ClientLon, data.ClientAccuracyRadius, data.ClientASOrg,
+		data.ServerCity, data.ServerLat, data.ServerLon, data.ServerAccuracyRadius, data.ServerASOrg,
+		data.EdnsCity, data.EdnsLat, data.EdnsLon, data.EdnsAccuracyRadius, data.EdnsASOrg,
+		data.GeoIPCityEpoch, data.GeoIPASNEpoch,
+		data.ClientBGPPrefix, data.ClientBGPASN,
+		data.ServerBGPPrefix, data.ServerBGPASN,
+		data.EdnsBGPPrefix, data.EdnsBGPASN,
+		data.ResolverDistanceKM, data.EdnsDistanceKM,
+		data.CountryMismatch, data.RegionMismatch, data.ASNMismatch,
+	}
+}
+
+func (s *sqlStorage) Store(data *storeapi.LogData) error {
+	return s.storeWith(s.db, data)
+}
+
+func (s *sqlStorage) storeWith(ex execer, data *storeapi.LogData) error {
+	_, err := ex.Exec(s.upsert, upsertArgs(data)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = ex.Exec(s.observation, observationArgs(data)...)
+	if err != nil {
+		return err
+	}
+
+	if data.LatencyMS != nil {
+		return s.storeLatency(ex, data.ServerIP, *data.LatencyMS, *data.LastSeen)
+	}
+
+	return nil
+}
+
+// latencyBucket returns the upper bound (in milliseconds) of the
+// power of two histogram bucket for the latency
+func latencyBucket(ms int64) int64 {
+	bucket := int64(1)
+	for bucket < ms {
+		bucket *= 2
+	}
+	return bucket
+}
+
+// storeLatency counts the DNS to HTTP latency in the histogram for
+// the resolver
+func (s *sqlStorage) storeLatency(ex execer, serverIP string, ms int64, ts time.Time) error {
+	_, err := ex.Exec(s.latency, serverIP, latencyBucket(ms), ts)
+	return err
+}
+
+// StoreBatch stores each result in its own savepoint so a failing
+// result doesn't abort the transaction.
+func (s *sqlStorage) StoreBatch(batch []*storeapi.LogData) ([]error, error) {
+	errs := make([]error, len(batch))
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for i, data := range batch {
+		if _, err := tx.Exec("SAVEPOINT batch_item"); err != nil {
+			return nil, err
+		}
+
+		errs[i] = s.storeWith(tx, data)
+		if errs[i] != nil {
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT batch_item"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if _, err := tx.Exec("RELEASE SAVEPOINT batch_item"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return errs, nil
+}
+
+// StoreMany stores the results one by one in a transaction, with
+// the statements prepared once
+func (s *sqlStorage) StoreMany(batch []*storeapi.LogData) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsert, err := tx.Prepare(s.upsert)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	observation, err := tx.Prepare(s.observation)
+	if err != nil {
+		return err
+	}
+	defer observation.Close()
+	latency, err := tx.Prepare(s.latency)
+	if err != nil {
+		return err
+	}
+	defer latency.Close()
+
+	for _, data := range batch {
+		if _, err := upsert.Exec(upsertArgs(data)...); err != nil {
+			return err
+		}
+		if _, err := observation.Exec(observationArgs(data)...); err != nil {
+			return err
+		}
+		if data.LatencyMS != nil {
+			_, err := latency.Exec(data.ServerIP, latencyBucket(*data.LatencyMS), *data.LastSeen)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStorage) ClientResults(clientIP string) ([]storeapi.LogData, error) {
+	ips := []storeapi.LogData{}
+	err := s.db.Select(&ips, s.clientResults, clientIP)
+	if err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+func (s *sqlStorage) Ping() error {
+	return s.db.Ping()
+}
+
+func (s *sqlStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+)
+
+// The benchmarks compare storing results one at a time (as the store
+// did for each request) with StoreMany for batches from the writer.
+// They use an in-memory SQLite database, and Postgres as well when
+// DNSMAPPER_TEST_POSTGRES has a connection string for a database
+// with the migrations applied.
+
+func benchStorages(b *testing.B) map[string]Storage {
+	storages := map[string]Storage{}
+
+	st, err := Open("sqlite", ":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	storages["sqlite"] = st
+
+	if dsn := os.Getenv("DNSMAPPER_TEST_POSTGRES"); len(dsn) > 0 {
+		st, err := Open("postgres", dsn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		storages["postgres"] = st
+	}
+
+	return storages
+}
+
+func benchResult(i int) *storeapi.LogData {
+	now := time.Now().UTC()
+	latency := int64(i % 500)
+	return &storeapi.LogData{
+		// a few results for each client IP
+		ClientIP:  fmt.Sprintf("10.%d.%d.%d", (i/3)>>16&0xff, (i/3)>>8&0xff, (i/3)&0xff),
+		ServerIP:  fmt.Sprintf("192.0.2.%d", i%200),
+		EdnsNet:   fmt.Sprintf("192.0.2.%d", i%200),
+		TestIP:    "198.51.100.1",
+		ClientCC:  "US",
+		ServerCC:  "US",
+		EdnsCC:    "US",
+		LastSeen:  &now,
+		LatencyMS: &latency,
+		Family:    storeapi.FamilyIPv4,
+	}
+}
+
+func BenchmarkStore(b *testing.B) {
+	for name, st := range benchStorages(b) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := st.Store(benchResult(i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		st.Close()
+	}
+}
+
+func BenchmarkStoreMany(b *testing.B) {
+	const batchSize = 500
+
+	for name, st := range benchStorages(b) {
+		b.Run(name, func(b *testing.B) {
+			batch := make([]*storeapi.LogData, 0, batchSize)
+			for i := 0; i < b.N; i++ {
+				batch = append(batch, benchResult(i))
+				if len(batch) == batchSize || i == b.N-1 {
+					if err := st.StoreMany(batch); err != nil {
+						b.Fatal(err)
+					}
+					batch = batch[:0]
+				}
+			}
+		})
+		st.Close()
+	}
+}
@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLite(t *testing.T) {
+	st, err := OpenSpec("sqlite::memory:", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	earlier := now.Add(-time.Hour)
+	latency := int64(120)
+	lat, lon := 37.751, -97.822
+	bgpPrefix := "192.0.2.0/24"
+
+	data := &storeapi.LogData{
+		ClientIP:  "192.0.2.1",
+		ServerIP:  "198.51.100.53",
+		EdnsNet:   "192.0.2.0/24",
+		ClientCC:  "US",
+		HasEdns:   true,
+		LastSeen:  &now,
+		LatencyMS: &latency,
+		Family:    storeapi.FamilyIPv4,
+
+		ClientCity:           "Wichita",
+		ClientLat:            &lat,
+		ClientLon:            &lon,
+		ClientAccuracyRadius: 1000,
+		ClientASOrg:          "Example Networks",
+		GeoIPCityEpoch:       1700000000,
+		ClientBGPPrefix:      &bgpPrefix,
+		ClientBGPASN:         64500,
+
+		ResolverFingerprint: storeapi.ResolverFingerprint{
+			EdnsUDPSize: 1232,
+			RD:          true,
+			Transport:   "udp",
+		},
+	}
+	assert.NoError(t, st.Store(data))
+
+	// replayed older result is counted but doesn't replace the newer data
+	replayed := *data
+	replayed.LastSeen = &earlier
+	replayed.ClientCC = "CA"
+	replayed.ClientCity = "Toronto"
+
+	resolverOnly := &storeapi.LogData{ServerIP: "198.51.100.53", EdnsNet: "198.51.100.0/24", LastSeen: &now}
+	otherNet := &storeapi.LogData{ServerIP: "198.51.100.53", EdnsNet: "203.0.113.0/24", LastSeen: &now}
+
+	errs, err := st.StoreBatch([]*storeapi.LogData{&replayed, resolverOnly, resolverOnly, otherNet})
+	if assert.NoError(t, err) {
+		assert.Equal(t, []error{nil, nil, nil, nil}, errs)
+	}
+
+	ips, err := st.ClientResults("192.0.2.1")
+	if !assert.NoError(t, err) || !assert.Len(t, ips, 1) {
+		return
+	}
+	ip := ips[0]
+	assert.Equal(t, "US", ip.ClientCC)
+	assert.Equal(t, "198.51.100.53", ip.ServerIP)
+	assert.True(t, ip.HasEdns)
+	assert.Equal(t, uint16(1232), ip.EdnsUDPSize)
+	assert.True(t, ip.RD)
+	assert.Equal(t, storeapi.FamilyIPv4, ip.Family)
+	if assert.NotNil(t, ip.LastSeen) {
+		assert.True(t, now.Equal(*ip.LastSeen), "last seen %s", ip.LastSeen)
+	}
+	if assert.NotNil(t, ip.FirstSeen) {
+		assert.True(t, now.Equal(*ip.FirstSeen))
+	}
+	if assert.NotNil(t, ip.LatencyMS) {
+		assert.Equal(t, latency, *ip.LatencyMS)
+	}
+
+	assert.Equal(t, int64(2), ip.SeenCount)
+
+	assert.Equal(t, "Wichita", ip.ClientCity)
+	if assert.NotNil(t, ip.ClientLat) && assert.NotNil(t, ip.ClientLon) {
+		assert.Equal(t, lat, *ip.ClientLat)
+		assert.Equal(t, lon, *ip.ClientLon)
+	}
+	assert.Equal(t, uint16(1000), ip.ClientAccuracyRadius)
+	assert.Equal(t, "Example Networks", ip.ClientASOrg)
+	assert.Nil(t, ip.ServerLat, "no location")
+	assert.Equal(t, uint(1700000000), ip.GeoIPCityEpoch)
+	if assert.NotNil(t, ip.ClientBGPPrefix) {
+		assert.Equal(t, bgpPrefix, *ip.ClientBGPPrefix)
+	}
+	assert.Equal(t, uint(64500), ip.ClientBGPASN)
+	assert.Nil(t, ip.ServerBGPPrefix)
+
+	ips, err = st.ClientResults("")
+	if assert.NoError(t, err) && assert.Len(t, ips, 2, "a resolver-only row for each ECS net") {
+		seen := map[string]int64{}
+		for _, ip := range ips {
+			seen[ip.EdnsNet] = ip.SeenCount
+		}
+		assert.Equal(t, map[string]int64{"198.51.100.0/24": 2, "203.0.113.0/24": 1}, seen)
+	}
+
+	db := st.(*sqliteStorage).db
+	count := func() (n int) {
+		assert.NoError(t, db.Get(&n, "SELECT count(*) FROM observations"))
+		return n
+	}
+	assert.Equal(t, 5, count(), "all results are in the history")
+
+	assert.NoError(t, st.MaintainHistory(now, 0))
+	assert.Equal(t, 5, count(), "no retention")
+
+	assert.NoError(t, st.MaintainHistory(now, 30*time.Minute))
+	assert.Equal(t, 4, count(), "expired the replayed result")
+}
+
+func TestLatencyBucket(t *testing.T) {
+	assert.Equal(t, int64(1), latencyBucket(0))
+	assert.Equal(t, int64(128), latencyBucket(120))
+	assert.Equal(t, int64(128), latencyBucket(128))
+	assert.Equal(t, int64(256), latencyBucket(129))
+}
+
+func TestSQLiteStoreMany(t *testing.T) {
+	st, err := Open("sqlite", ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.Close()
+
+	batch := []*storeapi.LogData{}
+	for i := 0; i < 6; i++ {
+		data := benchResult(i)
+		data.ClientIP = "192.0.2.1"
+		data.ServerIP = "198.51.100.53"
+		batch = append(batch, data)
+	}
+	assert.NoError(t, st.StoreMany(batch))
+
+	ips, err := st.ClientResults("192.0.2.1")
+	if assert.NoError(t, err) && assert.Len(t, ips, 1) {
+		assert.Equal(t, int64(6), ips[0].SeenCount)
+	}
+
+	// a failing result doesn't store any of the batch
+	bad := benchResult(7)
+	bad.LastSeen = nil
+	err = st.StoreMany([]*storeapi.LogData{benchResult(8), bad})
+	assert.Error(t, err)
+	ips, err = st.ClientResults(benchResult(8).ClientIP)
+	assert.NoError(t, err)
+	assert.Len(t, ips, 0)
+}
+
+func TestSQLiteBGPPrefixes(t *testing.T) {
+	st, err := Open("sqlite", ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.Close()
+
+	prefixes, err := st.BGPPrefixes()
+	assert.NoError(t, err)
+	assert.Empty(t, prefixes)
+
+	first := []BGPPrefix{
+		{Prefix: "192.0.2.0/24", OriginASN: 64500, ASName: "EXAMPLE"},
+		{Prefix: "2001:db8::/32", OriginASN: 64501},
+	}
+	assert.NoError(t, st.ReplaceBGPPrefixes(first))
+	prefixes, err = st.BGPPrefixes()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, first, prefixes)
+
+	second := []BGPPrefix{{Prefix: "198.51.100.0/24", OriginASN: 64502}}
+	assert.NoError(t, st.ReplaceBGPPrefixes(second))
+	prefixes, err = st.BGPPrefixes()
+	assert.NoError(t, err)
+	assert.Equal(t, second, prefixes, "the import replaces the prefixes")
+
+	assert.Error(t, st.ReplaceBGPPrefixes(append(second, second...)), "duplicate prefix")
+	prefixes, err = st.BGPPrefixes()
+	assert.NoError(t, err)
+	assert.Equal(t, second, prefixes, "a failed import keeps the prefixes")
+}
+
+func TestSQLiteFarResolvers(t *testing.T) {
+	st, err := Open("sqlite", ":memory:")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer st.Close()
+
+	now := time.Now().UTC()
+	result := func(client, server string, km float64, countryMismatch bool) *storeapi.LogData {
+		return &storeapi.LogData{
+			ClientIP:           client,
+			ServerIP:           server,
+			EdnsNet:            server,
+			LastSeen:           &now,
+			ResolverDistanceKM: &km,
+			CountryMismatch:    countryMismatch,
+		}
+	}
+
+	batch := []*storeapi.LogData{
+		// a resolver with clients close by
+		result("192.0.2.1", "198.51.100.1", 10, false),
+		result("192.0.2.2", "198.51.100.1", 20, false),
+		result("192.0.2.3", "198.51.100.1", 1500, true),
+		// and one serving clients far away
+		result("192.0.2.4", "198.51.100.2", 5000, true),
+		result("192.0.2.5", "198.51.100.2", 3000, true),
+		result("192.0.2.5", "198.51.100.2", 3000, true),
+		// too few observations
+		result("192.0.2.6", "198.51.100.3", 9000, true),
+		// resolver-only results don't have a distance
+		{ServerIP: "198.51.100.4", EdnsNet: "198.51.100.4", LastSeen: &now},
+		{ServerIP: "198.51.100.4", EdnsNet: "198.51.100.4", LastSeen: &now},
+	}
+	assert.NoError(t, st.StoreMany(batch))
+
+	resolvers, err := st.FarResolvers(now.Add(-time.Hour), 1000, 2, 10)
+	if !assert.NoError(t, err) || !assert.Len(t, resolvers, 2) {
+		return
+	}
+
+	far := resolvers[0]
+	assert.Equal(t, "198.51.100.2", far.ServerIP)
+	assert.Equal(t, int64(3), far.Observations)
+	assert.Equal(t, int64(2), far.Clients)
+	assert.Equal(t, int64(3), far.Far)
+	assert.InDelta(t, 3666.7, far.AvgDistanceKM, 0.1)
+	assert.Equal(t, 5000.0, far.MaxDistanceKM)
+	assert.Equal(t, int64(3), far.CountryMismatches)
+
+	assert.Equal(t, "198.51.100.1", resolvers[1].ServerIP)
+	assert.Equal(t, int64(1), resolvers[1].Far)
+	assert.Equal(t, int64(1), resolvers[1].CountryMismatches)
+
+	resolvers, err = st.FarResolvers(now.Add(time.Hour), 1000, 1, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, resolvers, "no observations since")
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+)
+
+// maxRequestSize limits how much of a request body is read, and how
+// large a decompressed batch can be
+const maxRequestSize = 10 << 20
+
+// authKeys has the shared secrets for signed submissions by key ID.
+// It's reloaded from -authkeys on SIGHUP so keys can be rotated
+// without a restart.
+type authKeys struct {
+	mu     sync.RWMutex
+	path   string
+	keys   map[string][]byte
+	maxAge time.Duration
+
+	// nonces seen within maxAge, to reject replayed requests
+	nonceMu   sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newAuthKeys(path string, maxAge time.Duration) (*authKeys, error) {
+	ak := &authKeys{
+		path:   path,
+		maxAge: maxAge,
+		nonces: map[string]time.Time{},
+	}
+	err := ak.load()
+	if err != nil {
+		return nil, err
+	}
+	return ak, nil
+}
+
+// load reads the key file; each line has a key ID and the secret
+// separated by whitespace. Empty lines and lines starting with #
+// are ignored.
+func (ak *authKeys) load() error {
+	f, err := os.Open(ak.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	keys := map[string][]byte{}
+
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
+			continue
+		}
+		fields := strings.Fields(s)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected key ID and secret", ak.path, line)
+		}
+		keys[fields[0]] = []byte(fields[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in %s", ak.path)
+	}
+
+	ak.mu.Lock()
+	ak.keys = keys
+	ak.mu.Unlock()
+
+	log.Printf("Loaded %d submission keys from %s", len(keys), ak.path)
+
+	return nil
+}
+
+func (ak *authKeys) secret(keyID string) ([]byte, bool) {
+	ak.mu.RLock()
+	defer ak.mu.RUnlock()
+	secret, ok := ak.keys[keyID]
+	return secret, ok
+}
+
+// useNonce returns false if the nonce was seen before
+func (ak *authKeys) useNonce(keyID, nonce string, now time.Time) bool {
+	ak.nonceMu.Lock()
+	defer ak.nonceMu.Unlock()
+
+	if now.Sub(ak.lastSweep) > ak.maxAge {
+		for n, t := range ak.nonces {
+			if now.Sub(t) > 2*ak.maxAge {
+				delete(ak.nonces, n)
+			}
+		}
+		ak.lastSweep = now
+	}
+
+	key := keyID + " " + nonce
+	if _, ok := ak.nonces[key]; ok {
+		return false
+	}
+	ak.nonces[key] = now
+	return true
+}
+
+// verify checks the signature, timestamp and nonce of the request
+func (ak *authKeys) verify(req *http.Request, body []byte) error {
+	keyID := req.Header.Get(storeapi.HeaderKeyID)
+	if len(keyID) == 0 {
+		return fmt.Errorf("request isn't signed")
+	}
+	secret, ok := ak.secret(keyID)
+	if !ok {
+		return fmt.Errorf("unknown key '%s'", keyID)
+	}
+
+	if err := storeapi.CheckSignature(req, body, secret); err != nil {
+		return err
+	}
+
+	ts, err := strconv.ParseInt(req.Header.Get(storeapi.HeaderTimestamp), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp")
+	}
+	now := time.Now()
+	if skew := now.Sub(time.Unix(ts, 0)); skew > ak.maxAge || skew < -ak.maxAge {
+		return fmt.Errorf("stale request (%s)", skew)
+	}
+
+	nonce := req.Header.Get(storeapi.HeaderNonce)
+	if len(nonce) < 16 {
+		return fmt.Errorf("invalid nonce")
+	}
+	if !ak.useNonce(keyID, nonce, now) {
+		return fmt.Errorf("replayed request")
+	}
+
+	return nil
+}
+
+// requireSignature rejects requests that aren't signed with one of
+// the configured keys
+func (ak *authKeys) requireSignature(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxRequestSize))
+		if err != nil {
+			http.Error(w, "Could not read request", 400)
+			return
+		}
+
+		if err := ak.verify(req, body); err != nil {
+			log.Printf("Rejected submission from %s: %s", req.RemoteAddr, err)
+			authFailures.Inc()
+			http.Error(w, "Unauthorized: "+err.Error(), 401)
+			return
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		h.ServeHTTP(w, req)
+	})
+}
+
+// requireClientCert rejects requests without a client certificate
+// verified against -tlsclientca. The listener only asks for one so
+// /healthz and /metrics work without.
+func requireClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			log.Printf("Rejected request from %s without a client certificate", req.RemoteAddr)
+			authFailures.Inc()
+			http.Error(w, "Unauthorized: client certificate required", 401)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
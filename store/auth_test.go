@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAuthKeys(t *testing.T) *authKeys {
+	path := filepath.Join(t.TempDir(), "keys")
+	if err := os.WriteFile(path, []byte("# test keys\nnode1 secret1\nnode2 secret2\n"), 0600); err != nil {
+		t.Fatalf("write keys: %s", err)
+	}
+	ak, err := newAuthKeys(path, time.Minute)
+	if err != nil {
+		t.Fatalf("newAuthKeys: %s", err)
+	}
+	return ak
+}
+
+func TestRequireSignature(t *testing.T) {
+	ak := testAuthKeys(t)
+
+	var received []byte
+	h := ak.requireSignature(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received, _ = io.ReadAll(req.Body)
+		w.WriteHeader(204)
+	}))
+
+	body := []byte(`{"ClientIP":"192.0.2.1","ServerIP":"198.51.100.1"}`)
+
+	signed := func(keyID, secret string) *http.Request {
+		req := httptest.NewRequest("POST", "/api/v2/store-result", bytes.NewReader(body))
+		if err := storeapi.SignRequest(req, body, keyID, []byte(secret)); err != nil {
+			t.Fatalf("sign: %s", err)
+		}
+		return req
+	}
+
+	// resign updates the signature after the headers were changed
+	resign := func(req *http.Request, secret string) {
+		req.Header.Set(storeapi.HeaderSignature, storeapi.Signature([]byte(secret),
+			req.Method, req.URL.Path,
+			req.Header.Get(storeapi.HeaderTimestamp), req.Header.Get(storeapi.HeaderNonce),
+			body))
+	}
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		code int
+	}{
+		{"signed", func() *http.Request { return signed("node1", "secret1") }, 204},
+		{"second key", func() *http.Request { return signed("node2", "secret2") }, 204},
+		{"unsigned", func() *http.Request {
+			return httptest.NewRequest("POST", "/api/v2/store-result", bytes.NewReader(body))
+		}, 401},
+		{"GET isn't signed", func() *http.Request {
+			return httptest.NewRequest("GET", "/api/v2/store-result", nil)
+		}, 204},
+		{"unknown key", func() *http.Request { return signed("node3", "secret1") }, 401},
+		{"wrong secret", func() *http.Request { return signed("node1", "secret2") }, 401},
+		{"tampered body", func() *http.Request {
+			req := signed("node1", "secret1")
+			req.Body = io.NopCloser(bytes.NewReader(bytes.Replace(body, []byte("192.0.2.1"), []byte("192.0.2.2"), 1)))
+			return req
+		}, 401},
+		{"other path", func() *http.Request {
+			req := signed("node1", "secret1")
+			req.URL.Path = "/api/v1/store-result"
+			return req
+		}, 401},
+		{"stale timestamp", func() *http.Request {
+			req := signed("node1", "secret1")
+			req.Header.Set(storeapi.HeaderTimestamp, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+			resign(req, "secret1")
+			return req
+		}, 401},
+		{"future timestamp", func() *http.Request {
+			req := signed("node1", "secret1")
+			req.Header.Set(storeapi.HeaderTimestamp, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+			resign(req, "secret1")
+			return req
+		}, 401},
+		{"short nonce", func() *http.Request {
+			req := signed("node1", "secret1")
+			req.Header.Set(storeapi.HeaderNonce, "abc")
+			resign(req, "secret1")
+			return req
+		}, 401},
+	}
+
+	for _, test := range tests {
+		received = nil
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, test.req())
+		assert.Equal(t, test.code, w.Code, test.name)
+		if test.code == 204 && test.name != "GET isn't signed" {
+			assert.Equal(t, body, received, "%s: body passed on", test.name)
+		}
+	}
+
+	// replaying the same request
+	req := signed("node1", "secret1")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, 204, w.Code)
+
+	replay := httptest.NewRequest("POST", "/api/v2/store-result", bytes.NewReader(body))
+	replay.Header = req.Header.Clone()
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, replay)
+	assert.Equal(t, 401, w.Code, "replayed nonce")
+}
+
+func TestSignedClient(t *testing.T) {
+	ak := testAuthKeys(t)
+
+	var stored int
+	srv := httptest.NewServer(ak.requireSignature(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		stored++
+		w.WriteHeader(204)
+	})))
+	defer srv.Close()
+
+	c := storeapi.NewClient(srv.URL)
+	data := &storeapi.ResultV2{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}
+
+	c.KeyID, c.Secret = "node1", []byte("secret1")
+	assert.NoError(t, c.StoreResult(context.Background(), data))
+	assert.NoError(t, c.StoreResult(context.Background(), data), "new nonce for each request")
+
+	c.Secret = []byte("secret2")
+	err := c.StoreResult(context.Background(), data)
+	if assert.Error(t, err) {
+		statusErr, ok := err.(*storeapi.StatusError)
+		if assert.True(t, ok) {
+			assert.Equal(t, 401, statusErr.StatusCode)
+		}
+	}
+
+	assert.Equal(t, 2, stored)
+}
+
+func TestRequireClientCert(t *testing.T) {
+	h := requireClientCert(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(204)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/api/v2/store-result", nil))
+	assert.Equal(t, 401, w.Code, "no TLS")
+
+	req := httptest.NewRequest("POST", "/api/v2/store-result", nil)
+	req.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code, "no client certificate")
+
+	req.TLS.VerifiedChains = [][]*x509.Certificate{{{}}}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, 204, w.Code)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxBatchSize is the most results accepted in one request
+const maxBatchSize = 1000
+
+var errBatchTooLarge = fmt.Errorf("more than %d results in the batch", maxBatchSize)
+
+var errQueueFull = errors.New("too many results queued, try again later")
+
+var errRequestTooLarge = fmt.Errorf("request larger than %d bytes", maxRequestSize)
+
+// sizeLimitReader fails with errRequestTooLarge when more than N-1
+// bytes are read; unlike io.LimitReader the request isn't silently
+// cut short.
+type sizeLimitReader struct {
+	io.LimitedReader
+}
+
+func newSizeLimitReader(r io.Reader, max int64) *sizeLimitReader {
+	return &sizeLimitReader{io.LimitedReader{R: r, N: max + 1}}
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.LimitedReader.Read(p)
+	if r.N <= 0 {
+		return n, errRequestTooLarge
+	}
+	return n, err
+}
+
+// storeBatchHandler takes a JSON array or NDJSON (optionally gzip
+// compressed) of v1 results and stores them in one transaction. The
+// response has the errors for the results that weren't stored.
+func storeBatchHandler(w rest.ResponseWriter, r *rest.Request) {
+	storeBatchRequest(w, r, false)
+}
+
+// storeBatchV2Handler is storeBatchHandler for v2 results
+func storeBatchV2Handler(w rest.ResponseWriter, r *rest.Request) {
+	storeBatchRequest(w, r, true)
+}
+
+func storeBatchRequest(w rest.ResponseWriter, r *rest.Request, v2 bool) {
+
+	timer := prometheus.NewTimer(ingestDuration)
+	defer timer.ObserveDuration()
+
+	now := time.Now().UTC()
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			rest.Error(w, "Could not decompress request: "+err.Error(), 400)
+			return
+		}
+		defer gz.Close()
+		body = newSizeLimitReader(gz, maxRequestSize)
+	}
+
+	batch, err := decodeBatch(body, v2, now)
+	var maxBytesErr *http.MaxBytesError
+	if err == errBatchTooLarge || errors.Is(err, errRequestTooLarge) || errors.As(err, &maxBytesErr) {
+		rest.Error(w, err.Error(), 413)
+		return
+	}
+	if err != nil {
+		rest.Error(w, "Could not decode JSON: "+err.Error(), 400)
+		return
+	}
+
+	result, err := storeBatch(batch, submitter(r.Request), now)
+	if err == errQueueFull {
+		w.Header().Set("Retry-After", retryAfter)
+		rest.Error(w, err.Error(), 503)
+		return
+	}
+	if err != nil {
+		log.Printf("Could not store batch: %s", err)
+		rest.Error(w, "Could not store results", 500)
+		return
+	}
+
+	w.WriteJson(result)
+}
+
+// decodeBatch reads either a JSON array or a stream of JSON objects;
+// v1 results are converted to v2.
+func decodeBatch(r io.Reader, v2 bool, now time.Time) ([]*storeapi.ResultV2, error) {
+	br := bufio.NewReader(r)
+
+	isArray := false
+	for {
+		b, err := br.Peek(1)
+		if err == io.EOF {
+			return nil, errors.New("empty request")
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[':
+			isArray = true
+		}
+		break
+	}
+
+	dec := json.NewDecoder(br)
+
+	decode := func(raw json.RawMessage) (*storeapi.ResultV2, error) {
+		if v2 {
+			result := &storeapi.ResultV2{}
+			err := json.Unmarshal(raw, result)
+			return result, err
+		}
+		data := &storeapi.RequestData{}
+		if err := json.Unmarshal(raw, data); err != nil {
+			return nil, err
+		}
+		return data.V2(now), nil
+	}
+
+	raws := []json.RawMessage{}
+
+	if isArray {
+		// the elements are read one at a time so a large batch
+		// fails before all of it is read
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		for dec.More() {
+			raw := json.RawMessage{}
+			if err := dec.Decode(&raw); err != nil {
+				return nil, err
+			}
+			if len(raws) == maxBatchSize {
+				return nil, errBatchTooLarge
+			}
+			raws = append(raws, raw)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	} else {
+		for {
+			raw := json.RawMessage{}
+			err := dec.Decode(&raw)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(raws) == maxBatchSize {
+				return nil, errBatchTooLarge
+			}
+			raws = append(raws, raw)
+		}
+	}
+
+	batch := make([]*storeapi.ResultV2, 0, len(raws))
+	for _, raw := range raws {
+		result, err := decode(raw)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, result)
+	}
+
+	return batch, nil
+}
+
+// storeBatch queues the valid results for writing; the results are
+// all queued or, if the queue is full, none of them. Stored in the
+// result is the number of results queued.
+func storeBatch(batch []*storeapi.ResultV2, submitter string, now time.Time) (*storeapi.BatchResult, error) {
+	result := &storeapi.BatchResult{}
+
+	valid := make([]*storeapi.LogData, 0, len(batch))
+
+	for i, item := range batch {
+		data, err := logData(item, now)
+		if err != nil {
+			result.Errors = append(result.Errors, storeapi.BatchError{Index: i, Error: err.Error()})
+			continue
+		}
+		data.Submitter = submitter
+		valid = append(valid, data)
+	}
+
+	if !writer.Add(valid...) {
+		return nil, errQueueFull
+	}
+	result.Stored = len(valid)
+
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoreBatch(t *testing.T) {
+	st := &blockingStorage{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	close(st.release)
+	writer = newDBWriter(st, 5*maxBatchSize, 100, time.Millisecond)
+	defer func() {
+		writer.Close()
+		writer = nil
+	}()
+
+	srv := httptest.NewServer(buildMux())
+	defer srv.Close()
+
+	post := func(body []byte, gz bool) (int, *storeapi.BatchResult) {
+		if gz {
+			buf := &bytes.Buffer{}
+			zw := gzip.NewWriter(buf)
+			zw.Write(body)
+			zw.Close()
+			body = buf.Bytes()
+		}
+		req, _ := http.NewRequest("POST", srv.URL+"/api/v2/store-results", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if gz {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0, nil
+		}
+		defer resp.Body.Close()
+		result := &storeapi.BatchResult{}
+		if resp.StatusCode == 200 {
+			assert.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+		}
+		return resp.StatusCode, result
+	}
+
+	results := func(n int) []string {
+		items := []string{}
+		for i := 0; i < n; i++ {
+			items = append(items, fmt.Sprintf(`{"ClientIP":"192.0.2.%d","ServerIP":"198.51.100.1"}`, i%250))
+		}
+		return items
+	}
+	array := func(items []string) []byte { return []byte("[" + strings.Join(items, ",") + "]") }
+	ndjson := func(items []string) []byte { return []byte(strings.Join(items, "\n") + "\n") }
+
+	items := append(results(2), `{"ClientIP":"192.0.2.1","ServerIP":"bogus"}`)
+
+	for _, test := range []struct {
+		name string
+		body []byte
+		gz   bool
+	}{
+		{"array", array(items), false},
+		{"ndjson", ndjson(items), false},
+		{"gzip array", array(items), true},
+		{"gzip ndjson", ndjson(items), true},
+	} {
+		code, result := post(test.body, test.gz)
+		if assert.Equal(t, 200, code, test.name) {
+			assert.Equal(t, 2, result.Stored, test.name)
+			if assert.Len(t, result.Errors, 1, test.name) {
+				assert.Equal(t, 2, result.Errors[0].Index, test.name)
+				assert.Contains(t, result.Errors[0].Error, "invalid ServerIP", test.name)
+			}
+		}
+	}
+
+	code, _ := post(array(results(maxBatchSize)), false)
+	assert.Equal(t, 200, code, "largest batch")
+	code, _ = post(array(results(maxBatchSize+1)), false)
+	assert.Equal(t, 413, code, "array too large")
+	code, _ = post(ndjson(results(maxBatchSize+1)), true)
+	assert.Equal(t, 413, code, "ndjson too large")
+
+	// a small request that decompresses to more than the limit
+	bomb := append([]byte("["), bytes.Repeat([]byte(" "), maxRequestSize+1)...)
+	code, _ = post(bomb, true)
+	assert.Equal(t, 413, code, "decompressed too large")
+
+	code, _ = post(bytes.Repeat([]byte(" "), maxRequestSize+1), false)
+	assert.Equal(t, 413, code, "body too large")
+
+	code, _ = post([]byte(`[{"ServerIP":`), false)
+	assert.Equal(t, 400, code, "invalid JSON")
+	code, _ = post(nil, false)
+	assert.Equal(t, 400, code, "empty request")
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/devel/dnsmapper/storage"
+)
+
+// bgpTable has the imported BGP prefixes used during ingest; it's
+// replaced by loadBGP.
+var bgpTable atomic.Pointer[prefixTable]
+
+// bgpRoute is an announced prefix and its origin ASN
+type bgpRoute struct {
+	prefix string
+	asn    uint
+}
+
+// prefixTable finds the most specific prefix for an address with a
+// map per prefix length. IPv4 prefixes are in the IPv4-mapped IPv6
+// space (so 192.0.2.0/24 has length 120).
+type prefixTable struct {
+	byLength map[int]map[[16]byte]bgpRoute
+	// the lengths in byLength, longest first
+	lengths []int
+	count   int
+}
+
+func newPrefixTable(prefixes []storage.BGPPrefix) (*prefixTable, error) {
+	t := &prefixTable{byLength: map[int]map[[16]byte]bgpRoute{}}
+
+	for _, p := range prefixes {
+		_, ipnet, err := net.ParseCIDR(p.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		ones, bits := ipnet.Mask.Size()
+		length := ones + 128 - bits
+
+		var key [16]byte
+		copy(key[:], ipnet.IP.To16())
+
+		m, ok := t.byLength[length]
+		if !ok {
+			m = map[[16]byte]bgpRoute{}
+			t.byLength[length] = m
+			t.lengths = append(t.lengths, length)
+		}
+		m[key] = bgpRoute{prefix: ipnet.String(), asn: p.OriginASN}
+		t.count++
+	}
+
+	sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+
+	return t, nil
+}
+
+// lookup returns the most specific prefix with the address
+func (t *prefixTable) lookup(ip net.IP) (bgpRoute, bool) {
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return bgpRoute{}, false
+	}
+	for _, length := range t.lengths {
+		var key [16]byte
+		copy(key[:], ip16.Mask(net.CIDRMask(length, 128)))
+		if route, ok := t.byLength[length][key]; ok {
+			return route, true
+		}
+	}
+	return bgpRoute{}, false
+}
+
+// bgpLookup returns the announced prefix and origin ASN for the
+// address; nil and 0 if it isn't in an imported prefix.
+func bgpLookup(ip net.IP) (*string, uint) {
+	t := bgpTable.Load()
+	if t == nil || ip == nil {
+		return nil, 0
+	}
+	route, ok := t.lookup(ip)
+	if !ok {
+		return nil, 0
+	}
+	return &route.prefix, route.asn
+}
+
+// loadBGP replaces bgpTable with the prefixes in the database
+func loadBGP() error {
+	prefixes, err := db.BGPPrefixes()
+	if err != nil {
+		return err
+	}
+	t, err := newPrefixTable(prefixes)
+	if err != nil {
+		return err
+	}
+	bgpTable.Store(t)
+	log.Printf("Loaded %d BGP prefixes", t.count)
+	return nil
+}
+
+// readRawTable reads an APNIC data-raw-table (or ipv6-raw-table)
+// file; a prefix and the origin ASN on each line. Prefixes that are
+// in the file more than once keep the first origin.
+func readRawTable(r io.Reader, seen map[string]bool) ([]storage.BGPPrefix, error) {
+	prefixes := []storage.BGPPrefix{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected a prefix and an ASN", line)
+		}
+
+		_, ipnet, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		asn, err := parseASN(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid ASN '%s'", line, fields[1])
+		}
+
+		prefix := ipnet.String()
+		if seen[prefix] {
+			continue
+		}
+		seen[prefix] = true
+
+		prefixes = append(prefixes, storage.BGPPrefix{Prefix: prefix, OriginASN: asn})
+	}
+
+	return prefixes, scanner.Err()
+}
+
+// readAutnums reads an APNIC data-used-autnums file; an ASN and the
+// name of the AS on each line.
+func readAutnums(r io.Reader) (map[uint]string, error) {
+	names := map[uint]string{}
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 {
+			continue
+		}
+		number, name, _ := strings.Cut(text, " ")
+		asn, err := parseASN(number)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid ASN '%s'", line, number)
+		}
+		names[asn] = strings.TrimSpace(name)
+	}
+
+	return names, scanner.Err()
+}
+
+func parseASN(s string) (uint, error) {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+	return uint(asn), err
+}
+
+const bgpImportUsage = `usage: store [flags] bgp-import [-autnums data-used-autnums] data-raw-table [ipv6-raw-table ...]`
+
+// bgpImportCommand runs the bgp-import subcommand with the arguments
+// after "bgp-import". The prefixes replace the imported ones in the
+// database; the store loads them when starting and on SIGHUP.
+func bgpImportCommand(args []string) error {
+	fs := flag.NewFlagSet("bgp-import", flag.ContinueOnError)
+	autnumsPath := fs.String("autnums", "", "APNIC data-used-autnums file with the AS names (optional)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New(bgpImportUsage)
+	}
+
+	prefixes := []storage.BGPPrefix{}
+	seen := map[string]bool{}
+	for _, path := range fs.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		table, err := readRawTable(f, seen)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		log.Printf("Read %d prefixes from '%s'", len(table), path)
+		prefixes = append(prefixes, table...)
+	}
+
+	if len(*autnumsPath) > 0 {
+		f, err := os.Open(*autnumsPath)
+		if err != nil {
+			return err
+		}
+		names, err := readAutnums(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", *autnumsPath, err)
+		}
+		for i := range prefixes {
+			prefixes[i].ASName = names[prefixes[i].OriginASN]
+		}
+	}
+
+	st, err := storage.OpenSpec(*dbSpec, pgConnString())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	if err := st.ReplaceBGPPrefixes(prefixes); err != nil {
+		return err
+	}
+	log.Printf("Imported %d BGP prefixes; send SIGHUP to running stores to load them", len(prefixes))
+
+	return nil
+}
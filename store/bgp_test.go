@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/devel/dnsmapper/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRawTable = `1.0.0.0/24	13335
+1.0.4.0/22	38803
+1.0.4.0/24	38803
+1.0.5.0/24	64500
+1.0.5.0/24	64501
+`
+
+const testRawTableV6 = `2001:db8::/32	64502
+`
+
+const testAutnums = `     1 LVLT-1 - Level 3 Parent, LLC, US
+ 13335 CLOUDFLARENET - Cloudflare, Inc., US
+ 38803 WPL-AS-AP Wirefreebroadband Pty Ltd, AU
+`
+
+func TestReadRawTable(t *testing.T) {
+	seen := map[string]bool{}
+	prefixes, err := readRawTable(strings.NewReader(testRawTable), seen)
+	if assert.NoError(t, err) && assert.Len(t, prefixes, 4, "duplicates are skipped") {
+		assert.Equal(t, storage.BGPPrefix{Prefix: "1.0.0.0/24", OriginASN: 13335}, prefixes[0])
+		assert.Equal(t, storage.BGPPrefix{Prefix: "1.0.5.0/24", OriginASN: 64500}, prefixes[3])
+	}
+
+	for _, data := range []string{"1.0.0.0/24\n", "1.0.0.0/33 13335\n", "1.0.0.0/24 ASX\n"} {
+		_, err := readRawTable(strings.NewReader(data), map[string]bool{})
+		assert.Error(t, err, data)
+	}
+}
+
+func TestReadAutnums(t *testing.T) {
+	names, err := readAutnums(strings.NewReader(testAutnums))
+	if assert.NoError(t, err) {
+		assert.Len(t, names, 3)
+		assert.Equal(t, "CLOUDFLARENET - Cloudflare, Inc., US", names[13335])
+	}
+}
+
+func TestPrefixTable(t *testing.T) {
+	table, err := newPrefixTable([]storage.BGPPrefix{
+		{Prefix: "1.0.4.0/22", OriginASN: 38803},
+		{Prefix: "1.0.5.0/24", OriginASN: 64500},
+		{Prefix: "2001:db8::/32", OriginASN: 64502},
+		{Prefix: "2001:db8:1::/48", OriginASN: 64503},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	tests := []struct {
+		ip     string
+		prefix string
+		asn    uint
+	}{
+		{"1.0.4.1", "1.0.4.0/22", 38803},
+		{"1.0.5.1", "1.0.5.0/24", 64500},
+		{"1.0.7.255", "1.0.4.0/22", 38803},
+		{"2001:db8::1", "2001:db8::/32", 64502},
+		{"2001:db8:1::1", "2001:db8:1::/48", 64503},
+		{"1.0.8.1", "", 0},
+		{"2001:db9::1", "", 0},
+	}
+	for _, test := range tests {
+		route, ok := table.lookup(net.ParseIP(test.ip))
+		assert.Equal(t, test.asn > 0, ok, test.ip)
+		assert.Equal(t, test.prefix, route.prefix, test.ip)
+		assert.Equal(t, test.asn, route.asn, test.ip)
+	}
+
+	_, err = newPrefixTable([]storage.BGPPrefix{{Prefix: "1.0.0.0"}})
+	assert.Error(t, err)
+}
+
+func TestBGPImport(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+		return path
+	}
+	raw := write("data-raw-table", testRawTable)
+	raw6 := write("ipv6-raw-table", testRawTableV6)
+	autnums := write("data-used-autnums", testAutnums)
+
+	defer func(spec string) { *dbSpec = spec }(*dbSpec)
+	*dbSpec = "sqlite:" + filepath.Join(dir, "store.db")
+
+	assert.Error(t, bgpImportCommand(nil))
+	if !assert.NoError(t, bgpImportCommand([]string{"-autnums", autnums, raw, raw6})) {
+		return
+	}
+
+	var err error
+	db, err = storage.OpenSpec(*dbSpec, "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer func() {
+		db.Close()
+		db = nil
+		bgpTable.Store(nil)
+	}()
+
+	prefixes, err := db.BGPPrefixes()
+	if assert.NoError(t, err) {
+		assert.Len(t, prefixes, 5)
+		assert.Contains(t, prefixes, storage.BGPPrefix{
+			Prefix: "1.0.0.0/24", OriginASN: 13335, ASName: "CLOUDFLARENET - Cloudflare, Inc., US",
+		})
+	}
+
+	assert.NoError(t, loadBGP())
+	prefix, asn := bgpLookup(net.ParseIP("2001:db8::53"))
+	if assert.NotNil(t, prefix) {
+		assert.Equal(t, "2001:db8::/32", *prefix)
+	}
+	assert.Equal(t, uint(64502), asn)
+
+	prefix, asn = bgpLookup(nil)
+	assert.Nil(t, prefix)
+	assert.Zero(t, asn)
+}
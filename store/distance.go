@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/devel/dnsmapper/storage"
+	"github.com/devel/dnsmapper/storeapi"
+)
+
+// earthRadiusKM is the mean radius of the earth
+const earthRadiusKM = 6371.0
+
+// distanceKM returns the great-circle distance between the locations
+// (with the haversine formula); nil if either isn't known.
+func distanceKM(lat1, lon1, lat2, lon2 *float64) *float64 {
+	if lat1 == nil || lon1 == nil || lat2 == nil || lon2 == nil {
+		return nil
+	}
+
+	radians := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := radians(*lat2 - *lat1)
+	dLon := radians(*lon2 - *lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(radians(*lat1))*math.Cos(radians(*lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	d := 2 * earthRadiusKM * math.Asin(math.Min(1, math.Sqrt(a)))
+
+	return &d
+}
+
+// compareLocations sets the distances from the client to the resolver
+// and ECS locations and the mismatch flags. Resolver-only results
+// don't have a client to compare with.
+func compareLocations(data *storeapi.LogData) {
+	if len(data.ClientIP) == 0 {
+		return
+	}
+
+	data.ResolverDistanceKM = distanceKM(data.ClientLat, data.ClientLon, data.ServerLat, data.ServerLon)
+	data.EdnsDistanceKM = distanceKM(data.ClientLat, data.ClientLon, data.EdnsLat, data.EdnsLon)
+
+	if len(data.ClientCC) > 0 && len(data.ServerCC) > 0 {
+		data.CountryMismatch = data.ClientCC != data.ServerCC
+		// region codes are only unique within a country
+		data.RegionMismatch = data.CountryMismatch ||
+			(len(data.ClientRC) > 0 && len(data.ServerRC) > 0 && data.ClientRC != data.ServerRC)
+	}
+	if data.ClientASN > 0 && data.ServerASN > 0 {
+		data.ASNMismatch = data.ClientASN != data.ServerASN
+	}
+}
+
+// farResolversCommand runs the far-resolvers subcommand with the
+// arguments after "far-resolvers"; it lists the resolvers that most
+// often serve clients far away.
+func farResolversCommand(args []string) error {
+	fs := flag.NewFlagSet("far-resolvers", flag.ContinueOnError)
+	since := fs.Duration("since", 30*24*time.Hour, "Use the observations from this long ago")
+	farKM := fs.Float64("km", 1000, "Clients further away than this (in km) are far")
+	minObservations := fs.Int("min", 10, "Only resolvers with at least this many observations")
+	limit := fs.Int("limit", 50, "Maximum number of resolvers")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	st, err := storage.OpenSpec(*dbSpec, pgConnString())
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	resolvers, err := st.FarResolvers(time.Now().Add(-*since), *farKM, *minObservations, *limit)
+	if err != nil {
+		return err
+	}
+
+	return writeFarResolvers(os.Stdout, resolvers)
+}
+
+func writeFarResolvers(w io.Writer, resolvers []storage.ResolverDistance) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "resolver\tobservations\tclients\tfar\tavg km\tmax km\tcountry\tregion\tasn\t")
+	for _, r := range resolvers {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.0f%%\t%.0f\t%.0f\t%d\t%d\t%d\t\n",
+			r.ServerIP, r.Observations, r.Clients,
+			100*float64(r.Far)/float64(r.Observations),
+			r.AvgDistanceKM, r.MaxDistanceKM,
+			r.CountryMismatches, r.RegionMismatches, r.ASNMismatches)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/devel/dnsmapper/storage"
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistanceKM(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	// Stockholm to Oslo
+	d := distanceKM(f(59.3293), f(18.0686), f(59.9139), f(10.7522))
+	if assert.NotNil(t, d) {
+		assert.InDelta(t, 417, *d, 2)
+	}
+
+	// Los Angeles to Tokyo, across the date line
+	d = distanceKM(f(34.0522), f(-118.2437), f(35.6762), f(139.6503))
+	if assert.NotNil(t, d) {
+		assert.InDelta(t, 8815, *d, 10)
+	}
+
+	d = distanceKM(f(10), f(10), f(10), f(10))
+	if assert.NotNil(t, d) {
+		assert.Zero(t, *d)
+	}
+
+	assert.Nil(t, distanceKM(nil, f(10), f(10), f(10)))
+}
+
+func TestCompareLocations(t *testing.T) {
+	lat, lon := 59.3293, 18.0686
+	farLat, farLon := 40.7128, -74.0060
+
+	data := &storeapi.LogData{
+		ClientIP: "192.0.2.1", ClientCC: "SE", ClientRC: "AB", ClientASN: 64500,
+		ClientLat: &lat, ClientLon: &lon,
+		ServerCC: "US", ServerRC: "AB", ServerASN: 64501,
+		ServerLat: &farLat, ServerLon: &farLon,
+		EdnsLat: &lat, EdnsLon: &lon,
+	}
+	compareLocations(data)
+	if assert.NotNil(t, data.ResolverDistanceKM) {
+		assert.InDelta(t, 6300, *data.ResolverDistanceKM, 50)
+	}
+	if assert.NotNil(t, data.EdnsDistanceKM) {
+		assert.Zero(t, *data.EdnsDistanceKM)
+	}
+	assert.True(t, data.CountryMismatch)
+	assert.True(t, data.RegionMismatch, "same region code in another country")
+	assert.True(t, data.ASNMismatch)
+
+	data = &storeapi.LogData{
+		ClientIP: "192.0.2.1", ClientCC: "SE", ClientRC: "AB", ClientASN: 64500,
+		ServerCC: "SE", ServerRC: "O", ServerASN: 64500,
+	}
+	compareLocations(data)
+	assert.Nil(t, data.ResolverDistanceKM, "no locations")
+	assert.False(t, data.CountryMismatch)
+	assert.True(t, data.RegionMismatch)
+	assert.False(t, data.ASNMismatch)
+
+	data = &storeapi.LogData{ClientIP: "192.0.2.1", ClientCC: "SE", ServerASN: 64500}
+	compareLocations(data)
+	assert.False(t, data.CountryMismatch, "unknown resolver country")
+	assert.False(t, data.RegionMismatch)
+	assert.False(t, data.ASNMismatch, "unknown client ASN")
+
+	data = &storeapi.LogData{ServerCC: "SE", ServerLat: &lat, ServerLon: &lon, EdnsLat: &farLat, EdnsLon: &farLon}
+	compareLocations(data)
+	assert.Nil(t, data.EdnsDistanceKM, "resolver-only result")
+}
+
+func TestWriteFarResolvers(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := writeFarResolvers(buf, []storage.ResolverDistance{
+		{ServerIP: "198.51.100.2", Observations: 4, Clients: 2, Far: 3, AvgDistanceKM: 3666.7, MaxDistanceKM: 5000, CountryMismatches: 3},
+	})
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, []string{"198.51.100.2", "4", "2", "75%", "3667", "5000", "3", "0", "0"}, strings.Fields(lines[1]))
+	}
+}
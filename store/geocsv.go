@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// csvColumns are the columns of a csv provider file; only the prefix
+// is required and the rest can be empty or left out.
+var csvColumns = []string{"prefix", "cc", "rc", "city", "lat", "lon", "accuracy_radius", "asn", "as_org"}
+
+// csvEntry is the data for a prefix in a csv file
+type csvEntry struct {
+	net  *net.IPNet
+	info GeoInfo
+}
+
+// csvProvider has a table of prefixes, for corrections to the other
+// providers. The most specific prefix containing an address is used.
+// Lines starting with # are comments.
+type csvProvider struct {
+	path string
+
+	mu      sync.RWMutex
+	entries []csvEntry
+	stamp   fileStamp
+}
+
+func newCSVProvider(path string) *csvProvider {
+	return &csvProvider{path: path}
+}
+
+func (p *csvProvider) Load() error {
+	stamp, err := statFile(p.path)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries, err := readGeoCSV(f, uint(stamp.modTime.Unix()))
+	if err != nil {
+		return fmt.Errorf("could not read '%s': %s", p.path, err)
+	}
+
+	p.mu.Lock()
+	p.entries, p.stamp = entries, stamp
+	p.mu.Unlock()
+
+	log.Printf("Loaded %d prefixes from '%s'", len(entries), p.path)
+
+	return nil
+}
+
+// readGeoCSV parses the csv file; epoch is used for the data in it
+func readGeoCSV(r io.Reader, epoch uint) ([]csvEntry, error) {
+	cr := csv.NewReader(r)
+	cr.Comment = '#'
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+
+	entries := []csvEntry{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := cr.FieldPos(0)
+
+		if len(record) > len(csvColumns) {
+			return nil, fmt.Errorf("line %d: %d columns, expected at most %d", line, len(record), len(csvColumns))
+		}
+		field := map[string]string{}
+		for i, v := range record {
+			field[csvColumns[i]] = strings.TrimSpace(v)
+		}
+
+		if line == 1 && field["prefix"] == "prefix" {
+			// header
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(field["prefix"])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		info := GeoInfo{
+			CC:    strings.ToUpper(field["cc"]),
+			RC:    field["rc"],
+			City:  field["city"],
+			ASOrg: field["as_org"],
+		}
+
+		if len(field["lat"]) > 0 || len(field["lon"]) > 0 {
+			lat, err := strconv.ParseFloat(field["lat"], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid lat '%s'", line, field["lat"])
+			}
+			lon, err := strconv.ParseFloat(field["lon"], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid lon '%s'", line, field["lon"])
+			}
+			info.Lat, info.Lon = &lat, &lon
+		}
+		if len(field["accuracy_radius"]) > 0 {
+			radius, err := strconv.ParseUint(field["accuracy_radius"], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid accuracy_radius '%s'", line, field["accuracy_radius"])
+			}
+			info.AccuracyRadius = uint16(radius)
+		}
+		if len(field["asn"]) > 0 {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(field["asn"]), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid asn '%s'", line, field["asn"])
+			}
+			info.ASN = uint(asn)
+		}
+
+		if info.hasLocation() {
+			info.LocationEpoch = epoch
+		}
+		if info.hasAS() {
+			info.ASNEpoch = epoch
+		}
+
+		entries = append(entries, csvEntry{net: ipnet, info: info})
+	}
+
+	return entries, nil
+}
+
+func (p *csvProvider) Changed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return fileChanged(p.path, p.stamp)
+}
+
+func (p *csvProvider) Lookup(ip net.IP) GeoInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var best *csvEntry
+	bestSize := -1
+	for i := range p.entries {
+		e := &p.entries[i]
+		if !e.net.Contains(ip) {
+			continue
+		}
+		if size, _ := e.net.Mask.Size(); size > bestSize {
+			best, bestSize = e, size
+		}
+	}
+	if best == nil {
+		return GeoInfo{}
+	}
+	return best.info
+}
+
+// Epochs has the modification time of the file
+func (p *csvProvider) Epochs() map[string]uint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stamp.modTime.IsZero() {
+		return nil
+	}
+	return map[string]uint{filepath.Base(p.path): uint(p.stamp.modTime.Unix())}
+}
+
+func (p *csvProvider) Close() error {
+	return nil
+}
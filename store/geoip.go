@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+const (
+	cityDBName = "GeoLite2-City.mmdb"
+	asnDBName  = "GeoLite2-ASN.mmdb"
+)
+
+// geo has the geo providers used by geoLookup
+var geo geoChain
+
+// maxmindProvider has the City and ASN readers. Lookups hold the read
+// lock, so when Load has swapped in new readers nothing is using the
+// old ones anymore and they can be closed.
+type maxmindProvider struct {
+	cityPath string
+	asnPath  string
+
+	mu   sync.RWMutex
+	city *geoip2.Reader
+	asn  *geoip2.Reader
+
+	// stamps of the files when they were loaded, to notice updates
+	cityStamp fileStamp
+	asnStamp  fileStamp
+}
+
+func newMaxMindProvider(dir string) *maxmindProvider {
+	return &maxmindProvider{
+		cityPath: filepath.Join(dir, cityDBName),
+		asnPath:  filepath.Join(dir, asnDBName),
+	}
+}
+
+// Load opens both databases and swaps them in. If either can't be
+// opened the current readers are kept.
+func (g *maxmindProvider) Load() error {
+	cityStamp, _ := statFile(g.cityPath)
+	asnStamp, _ := statFile(g.asnPath)
+
+	city, err := geoip2.Open(g.cityPath)
+	if err != nil {
+		return fmt.Errorf("could not open City GeoIP database '%s': %s", g.cityPath, err)
+	}
+	asn, err := geoip2.Open(g.asnPath)
+	if err != nil {
+		city.Close()
+		return fmt.Errorf("could not open ASN GeoIP database '%s': %s", g.asnPath, err)
+	}
+
+	g.mu.Lock()
+	oldCity, oldASN := g.city, g.asn
+	g.city, g.asn = city, asn
+	g.cityStamp, g.asnStamp = cityStamp, asnStamp
+	g.mu.Unlock()
+
+	log.Printf("Opened '%s' (%s, built %s)", g.cityPath, city.Metadata().DatabaseType, buildTime(city.Metadata().BuildEpoch))
+	log.Printf("Opened '%s' (%s, built %s)", g.asnPath, asn.Metadata().DatabaseType, buildTime(asn.Metadata().BuildEpoch))
+
+	if oldCity != nil {
+		oldCity.Close()
+	}
+	if oldASN != nil {
+		oldASN.Close()
+	}
+
+	return nil
+}
+
+// Changed returns true if either database file has been replaced
+// since it was loaded
+func (g *maxmindProvider) Changed() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return fileChanged(g.cityPath, g.cityStamp) || fileChanged(g.asnPath, g.asnStamp)
+}
+
+func (g *maxmindProvider) Lookup(ip net.IP) (r GeoInfo) {
+	// hold the databases for the lookups so a reload doesn't close
+	// them underneath us
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.city != nil {
+		record, err := g.city.City(ip)
+		if err != nil {
+			log.Printf("Could not lookup data for '%s': %s", ip.String(), err)
+		} else if record.Country.IsoCode != "" {
+			r.CC = record.Country.IsoCode
+
+			if len(record.Subdivisions) > 0 {
+				r.RC = record.Subdivisions[0].IsoCode
+			}
+
+			r.City = record.City.Names["en"]
+
+			// the accuracy radius is 0 when there's no location
+			if record.Location.AccuracyRadius > 0 {
+				lat, lon := record.Location.Latitude, record.Location.Longitude
+				r.Lat, r.Lon = &lat, &lon
+				r.AccuracyRadius = record.Location.AccuracyRadius
+			}
+
+			r.LocationEpoch = g.city.Metadata().BuildEpoch
+		}
+	}
+
+	if g.asn != nil {
+		asn, err := g.asn.ASN(ip)
+		if err != nil {
+			log.Printf("Could not lookup ASN data for '%s': %s", ip.String(), err)
+		} else if asn.AutonomousSystemNumber > 0 {
+			r.ASN = asn.AutonomousSystemNumber
+			r.ASOrg = asn.AutonomousSystemOrganization
+			r.ASNEpoch = g.asn.Metadata().BuildEpoch
+		}
+	}
+
+	return r
+}
+
+// Epochs returns the build time (seconds since the epoch) of the
+// loaded databases
+func (g *maxmindProvider) Epochs() map[string]uint {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	epochs := map[string]uint{}
+	if g.city != nil {
+		epochs["city"] = g.city.Metadata().BuildEpoch
+	}
+	if g.asn != nil {
+		epochs["asn"] = g.asn.Metadata().BuildEpoch
+	}
+	return epochs
+}
+
+func (g *maxmindProvider) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.city != nil {
+		g.city.Close()
+		g.city = nil
+	}
+	if g.asn != nil {
+		g.asn.Close()
+		g.asn = nil
+	}
+	return nil
+}
+
+func buildTime(epoch uint) string {
+	return time.Unix(int64(epoch), 0).UTC().Format(time.RFC3339)
+}
+
+// openGeoIP loads the -geo providers; the MaxMind databases are in
+// -geoip (or the GEOIP environment variable)
+func openGeoIP() {
+	path, _ := os.LookupEnv("GEOIP")
+
+	if len(*geoipPath) > 0 {
+		path = *geoipPath
+	}
+
+	var err error
+	geo, err = newGeoProviders(*geoProviders, path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := geo.Load(); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaxMindReload(t *testing.T) {
+	dir := t.TempDir()
+	g := newMaxMindProvider(dir)
+
+	assert.Error(t, g.Load(), "no databases")
+	assert.False(t, g.Changed(), "no files to reload")
+
+	for _, name := range []string{cityDBName, asnDBName} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte("partial"), 0644))
+	}
+	assert.True(t, g.Changed())
+	assert.Error(t, g.Load(), "invalid databases aren't loaded")
+	assert.Empty(t, g.Epochs())
+
+	// a failed load doesn't record the files as loaded, so they're
+	// tried again
+	assert.True(t, g.Changed())
+
+	g.cityStamp, _ = statFile(g.cityPath)
+	g.asnStamp, _ = statFile(g.asnPath)
+	assert.False(t, g.Changed())
+
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(g.asnPath, later, later))
+	assert.True(t, g.Changed(), "replaced ASN database")
+}
+
+func TestHealthHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest("GET", "/healthz", nil))
+
+	assert.Equal(t, 200, w.Code)
+
+	health := struct {
+		Status string
+		GeoIP  map[string]uint
+	}{}
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &health)) {
+		assert.Equal(t, "ok", health.Status)
+	}
+}
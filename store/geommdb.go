@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbLayout has the paths of the fields in the records of an mmdb
+// file, with dots between map keys and slice indexes. Empty paths
+// aren't in the file.
+type mmdbLayout struct {
+	CC, RC, City   string
+	Lat, Lon       string
+	AccuracyRadius string
+	ASN, ASOrg     string
+}
+
+// maxmindLayout is used by the GeoIP2/GeoLite2 databases and those
+// made to be compatible with them (DB-IP).
+var maxmindLayout = mmdbLayout{
+	CC:             "country.iso_code",
+	RC:             "subdivisions.0.iso_code",
+	City:           "city.names.en",
+	Lat:            "location.latitude",
+	Lon:            "location.longitude",
+	AccuracyRadius: "location.accuracy_radius",
+	ASN:            "autonomous_system_number",
+	ASOrg:          "autonomous_system_organization",
+}
+
+var mmdbLayouts = map[string]mmdbLayout{
+	"maxmind": maxmindLayout,
+	"dbip":    maxmindLayout,
+	// IPinfo's country_asn and location files
+	"ipinfo": {
+		CC:    "country",
+		City:  "city",
+		Lat:   "lat",
+		Lon:   "lng",
+		ASN:   "asn",
+		ASOrg: "as_name",
+	},
+}
+
+func mmdbLayoutNames() []string {
+	names := []string{}
+	for name := range mmdbLayouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mmdbProvider reads an mmdb file from any vendor with the layout of
+// its records. Reloading works like for maxmindProvider.
+type mmdbProvider struct {
+	path   string
+	layout mmdbLayout
+
+	mu     sync.RWMutex
+	reader *maxminddb.Reader
+	stamp  fileStamp
+}
+
+func newMMDBProvider(path string, layout mmdbLayout) *mmdbProvider {
+	return &mmdbProvider{path: path, layout: layout}
+}
+
+func (p *mmdbProvider) Load() error {
+	stamp, _ := statFile(p.path)
+
+	reader, err := maxminddb.Open(p.path)
+	if err != nil {
+		return fmt.Errorf("could not open mmdb database '%s': %s", p.path, err)
+	}
+
+	p.mu.Lock()
+	old := p.reader
+	p.reader, p.stamp = reader, stamp
+	p.mu.Unlock()
+
+	log.Printf("Opened '%s' (%s, built %s)", p.path, reader.Metadata.DatabaseType, buildTime(reader.Metadata.BuildEpoch))
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (p *mmdbProvider) Changed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return fileChanged(p.path, p.stamp)
+}
+
+func (p *mmdbProvider) Lookup(ip net.IP) GeoInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.reader == nil {
+		return GeoInfo{}
+	}
+
+	var record interface{}
+	if err := p.reader.Lookup(ip, &record); err != nil {
+		log.Printf("Could not lookup '%s' in '%s': %s", ip, p.path, err)
+		return GeoInfo{}
+	}
+
+	info := p.layout.info(record)
+	if info.hasLocation() {
+		info.LocationEpoch = p.reader.Metadata.BuildEpoch
+	}
+	if info.hasAS() {
+		info.ASNEpoch = p.reader.Metadata.BuildEpoch
+	}
+	return info
+}
+
+func (p *mmdbProvider) Epochs() map[string]uint {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.reader == nil {
+		return nil
+	}
+	return map[string]uint{filepath.Base(p.path): p.reader.Metadata.BuildEpoch}
+}
+
+func (p *mmdbProvider) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.reader == nil {
+		return nil
+	}
+	err := p.reader.Close()
+	p.reader = nil
+	return err
+}
+
+// info returns the fields of the layout from a decoded record
+func (l mmdbLayout) info(record interface{}) (info GeoInfo) {
+	info.CC = strings.ToUpper(mmdbString(record, l.CC))
+	info.RC = mmdbString(record, l.RC)
+	info.City = mmdbString(record, l.City)
+
+	lat, latOK := mmdbNumber(record, l.Lat)
+	lon, lonOK := mmdbNumber(record, l.Lon)
+	if latOK && lonOK {
+		info.Lat, info.Lon = &lat, &lon
+		if radius, ok := mmdbNumber(record, l.AccuracyRadius); ok {
+			info.AccuracyRadius = uint16(radius)
+		}
+	}
+
+	if asn, ok := mmdbNumber(record, l.ASN); ok {
+		info.ASN = uint(asn)
+	}
+	info.ASOrg = mmdbString(record, l.ASOrg)
+
+	return info
+}
+
+// mmdbValue returns the value at the path in the record
+func mmdbValue(record interface{}, path string) interface{} {
+	if len(path) == 0 {
+		return nil
+	}
+	v := record
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			v = node[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
+
+func mmdbString(record interface{}, path string) string {
+	s, _ := mmdbValue(record, path).(string)
+	return s
+}
+
+// mmdbNumber returns the number at the path; some vendors have
+// numbers as strings, and ASNs with an "AS" prefix.
+func mmdbNumber(record interface{}, path string) (float64, bool) {
+	switch v := mmdbValue(record, path).(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimPrefix(strings.ToUpper(v), "AS"), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
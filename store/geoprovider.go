@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// GeoInfo is what a GeoProvider knows about an address. The location
+// (CC through AccuracyRadius) and the AS are separate; a provider can
+// have either or both.
+type GeoInfo struct {
+	CC, RC string
+	City   string
+	// Lat and Lon are nil if there's no location for the address
+	Lat, Lon       *float64
+	AccuracyRadius uint16
+
+	ASN   uint
+	ASOrg string
+
+	// build times (seconds since the epoch) of the data the location
+	// and the AS came from
+	LocationEpoch, ASNEpoch uint
+}
+
+func (g *GeoInfo) hasLocation() bool {
+	return len(g.CC) > 0
+}
+
+func (g *GeoInfo) hasAS() bool {
+	return g.ASN > 0
+}
+
+// GeoProvider looks up the location and AS of addresses from some
+// data set, usually a file that can be updated while the store runs.
+type GeoProvider interface {
+	// Lookup returns what the provider has for the address; the zero
+	// GeoInfo if nothing.
+	Lookup(ip net.IP) GeoInfo
+
+	// Load (re)loads the data. If it fails the current data is kept.
+	Load() error
+
+	// Changed returns true if the data has been updated since it was
+	// loaded.
+	Changed() bool
+
+	// Epochs returns the build times of the loaded data by name
+	Epochs() map[string]uint
+
+	Close() error
+}
+
+// geoChain asks the providers in order of precedence. The location
+// and the AS each come from the first provider that has them, so an
+// override with just a country replaces the whole location (and
+// not the AS) from the providers after it.
+type geoChain []GeoProvider
+
+func (c geoChain) Lookup(ip net.IP) (info GeoInfo) {
+	if ip == nil {
+		return
+	}
+
+	for _, p := range c {
+		r := p.Lookup(ip)
+		if !info.hasLocation() && r.hasLocation() {
+			info.CC, info.RC, info.City = r.CC, r.RC, r.City
+			info.Lat, info.Lon, info.AccuracyRadius = r.Lat, r.Lon, r.AccuracyRadius
+			info.LocationEpoch = r.LocationEpoch
+		}
+		if !info.hasAS() && r.hasAS() {
+			info.ASN, info.ASOrg = r.ASN, r.ASOrg
+			info.ASNEpoch = r.ASNEpoch
+		}
+		if info.hasLocation() && info.hasAS() {
+			break
+		}
+	}
+
+	if !info.hasLocation() {
+		geoipFailures.WithLabelValues("city").Inc()
+		log.Printf("Could not lookup data for '%s': not found", ip)
+	}
+	if !info.hasAS() {
+		geoipFailures.WithLabelValues("asn").Inc()
+		log.Printf("Could not lookup ASN data for '%s': not found", ip)
+	}
+
+	return info
+}
+
+// Load loads all the providers; it returns the errors of those that
+// failed.
+func (c geoChain) Load() error {
+	var errs []error
+	for _, p := range c {
+		if err := p.Load(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (c geoChain) Changed() bool {
+	for _, p := range c {
+		if p.Changed() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c geoChain) Epochs() map[string]uint {
+	epochs := map[string]uint{}
+	for _, p := range c {
+		for name, epoch := range p.Epochs() {
+			epochs[name] = epoch
+		}
+	}
+	return epochs
+}
+
+func (c geoChain) Close() error {
+	var err error
+	for _, p := range c {
+		if cerr := p.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// reloadChanged loads the providers whose data has changed
+func (c geoChain) reloadChanged() {
+	for _, p := range c {
+		if !p.Changed() {
+			continue
+		}
+		if err := p.Load(); err != nil {
+			// a file being copied in might not be complete yet; it'll
+			// be tried again at the next check
+			log.Printf("Could not reload geo data: %s", err)
+		}
+	}
+}
+
+// watch reloads the providers when their data changes, checking at
+// each interval. Updates should replace the files (write a new file
+// and rename it) rather than write into the ones that are open.
+func (c geoChain) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		c.reloadChanged()
+	}
+}
+
+// newGeoProviders returns the providers in the comma separated spec,
+// highest precedence first:
+//
+//	maxmind                the GeoLite2/GeoIP2 City and ASN databases in dir
+//	mmdb:<layout>:<path>   another vendor's mmdb file (see mmdbLayouts)
+//	csv:<path>             a table of prefixes, for overrides
+//
+// The providers aren't loaded yet.
+func newGeoProviders(spec, dir string) (geoChain, error) {
+	chain := geoChain{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		kind, arg, _ := strings.Cut(item, ":")
+
+		switch kind {
+		case "maxmind":
+			chain = append(chain, newMaxMindProvider(dir))
+		case "mmdb":
+			layoutName, path, ok := strings.Cut(arg, ":")
+			layout, known := mmdbLayouts[layoutName]
+			if !ok || !known {
+				return nil, fmt.Errorf("invalid geo provider '%s'; use mmdb:<layout>:<path> with layout %s",
+					item, strings.Join(mmdbLayoutNames(), ", "))
+			}
+			chain = append(chain, newMMDBProvider(path, layout))
+		case "csv":
+			if len(arg) == 0 {
+				return nil, fmt.Errorf("invalid geo provider '%s'; use csv:<path>", item)
+			}
+			chain = append(chain, newCSVProvider(arg))
+		default:
+			return nil, fmt.Errorf("unknown geo provider '%s'", item)
+		}
+	}
+	return chain, nil
+}
+
+// fileStamp is what changes when a data file is replaced
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}, nil
+}
+
+// fileChanged returns true if the file exists and is different from
+// the stamp
+func fileChanged(path string, stamp fileStamp) bool {
+	current, err := statFile(path)
+	if err != nil {
+		return false
+	}
+	return current != stamp
+}
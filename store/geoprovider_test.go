@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// staticProvider has the same data for every address
+type staticProvider GeoInfo
+
+func (p staticProvider) Lookup(ip net.IP) GeoInfo { return GeoInfo(p) }
+func (p staticProvider) Load() error              { return nil }
+func (p staticProvider) Changed() bool            { return false }
+func (p staticProvider) Epochs() map[string]uint  { return nil }
+func (p staticProvider) Close() error             { return nil }
+
+func TestGeoChain(t *testing.T) {
+	lat, lon := 40.7, -74.0
+
+	override := staticProvider{CC: "DE", LocationEpoch: 3}
+	asnOnly := staticProvider{ASN: 64500, ASOrg: "Example", ASNEpoch: 2}
+	full := staticProvider{
+		CC: "US", RC: "NY", City: "New York",
+		Lat: &lat, Lon: &lon, AccuracyRadius: 50,
+		ASN: 64501, ASOrg: "Other", LocationEpoch: 1, ASNEpoch: 1,
+	}
+
+	ip := net.ParseIP("192.0.2.1")
+
+	info := geoChain{override, asnOnly, full}.Lookup(ip)
+	assert.Equal(t, GeoInfo{CC: "DE", LocationEpoch: 3, ASN: 64500, ASOrg: "Example", ASNEpoch: 2}, info,
+		"the location and AS come from the first provider with them")
+
+	info = geoChain{full, override}.Lookup(ip)
+	assert.Equal(t, GeoInfo(full), info)
+
+	assert.Equal(t, GeoInfo{}, geoChain{full}.Lookup(nil))
+	assert.Equal(t, GeoInfo{}, geoChain{}.Lookup(ip))
+}
+
+const testGeoCSV = `prefix,cc,rc,city,lat,lon,accuracy_radius,asn,as_org
+# corrections
+192.0.2.0/24,se,AB,Stockholm,59.33,18.06,20
+192.0.2.128/25,NO
+198.51.100.0/24,,,,,,,AS64500,Example Networks
+2001:db8::/32,DK
+`
+
+func TestCSVProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.csv")
+	assert.NoError(t, os.WriteFile(path, []byte(testGeoCSV), 0644))
+
+	p := newCSVProvider(path)
+	if !assert.NoError(t, p.Load()) {
+		return
+	}
+	assert.False(t, p.Changed())
+	assert.Len(t, p.Epochs(), 1)
+
+	info := p.Lookup(net.ParseIP("192.0.2.1"))
+	assert.Equal(t, "SE", info.CC)
+	assert.Equal(t, "AB", info.RC)
+	assert.Equal(t, "Stockholm", info.City)
+	if assert.NotNil(t, info.Lat) && assert.NotNil(t, info.Lon) {
+		assert.Equal(t, 59.33, *info.Lat)
+		assert.Equal(t, 18.06, *info.Lon)
+	}
+	assert.Equal(t, uint16(20), info.AccuracyRadius)
+	assert.NotZero(t, info.LocationEpoch)
+	assert.Zero(t, info.ASNEpoch)
+
+	assert.Equal(t, "NO", p.Lookup(net.ParseIP("192.0.2.200")).CC, "most specific prefix")
+	assert.Equal(t, "DK", p.Lookup(net.ParseIP("2001:db8::1")).CC)
+
+	info = p.Lookup(net.ParseIP("198.51.100.1"))
+	assert.False(t, info.hasLocation())
+	assert.Equal(t, uint(64500), info.ASN)
+	assert.Equal(t, "Example Networks", info.ASOrg)
+
+	assert.Equal(t, GeoInfo{}, p.Lookup(net.ParseIP("203.0.113.1")))
+
+	// an invalid file doesn't replace the loaded one
+	assert.NoError(t, os.WriteFile(path, []byte("not-a-prefix,US\n"), 0644))
+	assert.Error(t, p.Load())
+	assert.Equal(t, "SE", p.Lookup(net.ParseIP("192.0.2.1")).CC)
+}
+
+func TestReadGeoCSVErrors(t *testing.T) {
+	for _, data := range []string{
+		"192.0.2.0/24,US,,,north,10\n",
+		"192.0.2.0/24,US,,,,,,ASX\n",
+		"192.0.2.0/24,US,,,,,,,,extra\n",
+	} {
+		_, err := readGeoCSV(strings.NewReader(data), 0)
+		assert.Error(t, err, data)
+	}
+}
+
+func TestMMDBLayout(t *testing.T) {
+	// records as decoded by maxminddb
+	maxmind := map[string]interface{}{
+		"country":      map[string]interface{}{"iso_code": "US"},
+		"subdivisions": []interface{}{map[string]interface{}{"iso_code": "CA"}},
+		"city":         map[string]interface{}{"names": map[string]interface{}{"en": "Los Angeles"}},
+		"location": map[string]interface{}{
+			"latitude":        34.05,
+			"longitude":       -118.24,
+			"accuracy_radius": uint64(20),
+		},
+		"autonomous_system_number":       uint64(64500),
+		"autonomous_system_organization": "Example",
+	}
+	info := mmdbLayouts["dbip"].info(maxmind)
+	assert.Equal(t, "US", info.CC)
+	assert.Equal(t, "CA", info.RC)
+	assert.Equal(t, "Los Angeles", info.City)
+	if assert.NotNil(t, info.Lat) {
+		assert.Equal(t, 34.05, *info.Lat)
+	}
+	assert.Equal(t, uint16(20), info.AccuracyRadius)
+	assert.Equal(t, uint(64500), info.ASN)
+	assert.Equal(t, "Example", info.ASOrg)
+
+	ipinfo := map[string]interface{}{
+		"country": "se",
+		"asn":     "AS64501",
+		"as_name": "Example AB",
+		"lat":     "59.33",
+		"lng":     "18.06",
+	}
+	info = mmdbLayouts["ipinfo"].info(ipinfo)
+	assert.Equal(t, "SE", info.CC)
+	assert.Equal(t, uint(64501), info.ASN)
+	assert.Equal(t, "Example AB", info.ASOrg)
+	if assert.NotNil(t, info.Lon) {
+		assert.Equal(t, 18.06, *info.Lon)
+	}
+
+	info = mmdbLayouts["maxmind"].info(map[string]interface{}{"subdivisions": []interface{}{}})
+	assert.Equal(t, GeoInfo{}, info)
+}
+
+func TestNewGeoProviders(t *testing.T) {
+	chain, err := newGeoProviders("csv:/etc/overrides.csv, maxmind, mmdb:ipinfo:/data/country_asn.mmdb", "/data")
+	if assert.NoError(t, err) && assert.Len(t, chain, 3) {
+		assert.IsType(t, &csvProvider{}, chain[0])
+		assert.IsType(t, &maxmindProvider{}, chain[1])
+		assert.Equal(t, "/data/"+cityDBName, chain[1].(*maxmindProvider).cityPath)
+		assert.IsType(t, &mmdbProvider{}, chain[2])
+		assert.Equal(t, "/data/country_asn.mmdb", chain[2].(*mmdbProvider).path)
+	}
+
+	for _, spec := range []string{"", "geoip", "csv", "mmdb:/data/x.mmdb", "mmdb:unknown:/data/x.mmdb"} {
+		_, err := newGeoProviders(spec, "")
+		assert.Error(t, err, spec)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ingestDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "store_ingest_duration_seconds",
+			Help:    "Time to process and store a submitted result",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+
+	geoipFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_geoip_lookup_failures_total",
+			Help: "GeoIP lookups that failed or returned no data, by database",
+		},
+		[]string{"db"},
+	)
+
+	dbErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "store_db_errors_total",
+			Help: "Errors storing results in the database",
+		},
+	)
+
+	authFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "store_auth_failures_total",
+			Help: "Submissions rejected for a missing or invalid signature or client certificate",
+		},
+	)
+
+	writeRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "store_write_rejected_total",
+			Help: "Results rejected (503) because the write queue was full",
+		},
+	)
+
+	writeDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "store_write_duration_seconds",
+			Help:    "Time to write a batch of results to the database",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		},
+	)
+
+	writeBatchSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "store_write_batch_size",
+			Help:    "Results per database write",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+
+	writeQueueLength = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "store_write_queue_length",
+			Help: "Results waiting to be written to the database",
+		},
+		func() float64 {
+			if writer == nil {
+				return 0
+			}
+			return float64(writer.Len())
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(ingestDuration, geoipFailures, dbErrors, authFailures,
+		writeRejected, writeDuration, writeBatchSize, writeQueueLength)
+}
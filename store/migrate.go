@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	_ "github.com/lib/pq"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsTable has the versions that have been applied
+const migrationsTable = "schema_versions"
+
+// migrationLockID is the Postgres advisory lock that serializes
+// stores migrating the same database at once
+const migrationLockID = 0x646e736d
+
+var migrationName = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// loadMigrations returns the embedded migrations ordered by version
+func loadMigrations() ([]*migration, error) {
+	files, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+
+	for _, f := range files {
+		m := migrationName.FindStringSubmatch(f.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file name '%s'", f.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		buf, err := fs.ReadFile(migrationFiles, path.Join("migrations", f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mig, ok := byVersion[version]
+		if !ok {
+			mig = &migration{version: version, name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names ('%s' and '%s')", version, mig.name, m[2])
+		}
+
+		if m[3] == "up" {
+			mig.up = string(buf)
+		} else {
+			mig.down = string(buf)
+		}
+	}
+
+	migrations := make([]*migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if len(mig.up) == 0 {
+			return nil, fmt.Errorf("migration %d_%s has no up migration", mig.version, mig.name)
+		}
+		migrations = append(migrations, mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+
+	return migrations, nil
+}
+
+// migrator applies the embedded migrations to the Postgres database
+type migrator struct {
+	db         *sql.DB
+	migrations []*migration
+}
+
+func newMigrator(dsn string) (*migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	mg := &migrator{db: db, migrations: migrations}
+	if err := mg.createTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return mg, nil
+}
+
+func (mg *migrator) createTable() error {
+	unlock, err := mg.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = mg.db.Exec(`CREATE TABLE IF NOT EXISTS ` + migrationsTable + ` (
+		version int primary key,
+		name text not null,
+		applied_at timestamp with time zone not null default now()
+	)`)
+	return err
+}
+
+// lock waits for the migration lock and returns the function
+// releasing it. The lock belongs to a database session, so it's
+// taken and released on a connection kept aside for it.
+func (mg *migrator) lock() (func(), error) {
+	ctx := context.Background()
+
+	conn, err := mg.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not lock migrations: %s", err)
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID); err != nil {
+			log.Printf("Could not unlock migrations: %s", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+func (mg *migrator) Close() error {
+	return mg.db.Close()
+}
+
+// applied returns the versions that have been applied
+func (mg *migrator) applied() (map[int]bool, error) {
+	rows, err := mg.db.Query(`SELECT version FROM ` + migrationsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := map[int]bool{}
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		versions[version] = true
+	}
+	return versions, rows.Err()
+}
+
+// run executes the migration step and records it in one transaction
+func (mg *migrator) run(mig *migration, up bool) error {
+	tx, err := mg.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if _, err := tx.Exec(mig.up); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO `+migrationsTable+` (version, name) VALUES ($1, $2)`, mig.version, mig.name)
+	} else {
+		if len(mig.down) > 0 {
+			if _, err := tx.Exec(mig.down); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec(`DELETE FROM `+migrationsTable+` WHERE version = $1`, mig.version)
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Up applies the migrations that haven't been applied yet; other
+// stores migrating at the same time wait for the lock.
+func (mg *migrator) Up() (int, error) {
+	unlock, err := mg.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	applied, err := mg.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, mig := range mg.migrations {
+		if applied[mig.version] {
+			continue
+		}
+		log.Printf("Applying migration %04d_%s", mig.version, mig.name)
+		if err := mg.run(mig, true); err != nil {
+			return n, fmt.Errorf("migration %04d_%s: %s", mig.version, mig.name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Down reverts the latest steps applied migrations
+func (mg *migrator) Down(steps int) (int, error) {
+	unlock, err := mg.lock()
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	applied, err := mg.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for i := len(mg.migrations) - 1; i >= 0 && n < steps; i-- {
+		mig := mg.migrations[i]
+		if !applied[mig.version] {
+			continue
+		}
+		log.Printf("Reverting migration %04d_%s", mig.version, mig.name)
+		if err := mg.run(mig, false); err != nil {
+			return n, fmt.Errorf("migration %04d_%s: %s", mig.version, mig.name, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Baseline records the migrations up to the version as applied
+// without running them, for databases that were set up by hand.
+func (mg *migrator) Baseline(version int) error {
+	unlock, err := mg.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, mig := range mg.migrations {
+		if mig.version > version {
+			break
+		}
+		_, err := mg.db.Exec(`INSERT INTO `+migrationsTable+` (version, name) VALUES ($1, $2)
+			ON CONFLICT (version) DO NOTHING`, mig.version, mig.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Status writes the migrations and if they've been applied
+func (mg *migrator) Status(w io.Writer) error {
+	applied, err := mg.applied()
+	if err != nil {
+		return err
+	}
+	for _, mig := range mg.migrations {
+		state := "pending"
+		if applied[mig.version] {
+			state = "applied"
+		}
+		fmt.Fprintf(w, "%04d_%-30s %s\n", mig.version, mig.name, state)
+	}
+	return nil
+}
+
+const migrateUsage = `usage: store [flags] migrate up|down [steps]|status|baseline <version>`
+
+// migrateCommand runs the migrate subcommand with the arguments
+// after "migrate"
+func migrateCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	if strings.HasPrefix(*dbSpec, "sqlite:") {
+		log.Println("SQLite databases get their schema when opened; nothing to migrate")
+		return nil
+	}
+
+	mg, err := newMigrator(pgConnString())
+	if err != nil {
+		return err
+	}
+	defer mg.Close()
+
+	switch args[0] {
+	case "up":
+		n, err := mg.Up()
+		log.Printf("Applied %d migrations", n)
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps '%s'", args[1])
+			}
+		}
+		n, err := mg.Down(steps)
+		log.Printf("Reverted %d migrations", n)
+		return err
+
+	case "status":
+		return mg.Status(os.Stdout)
+
+	case "baseline":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid version '%s'", args[1])
+		}
+		return mg.Baseline(version)
+	}
+
+	return errors.New(migrateUsage)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if !assert.NoError(t, err) || !assert.NotEmpty(t, migrations) {
+		return
+	}
+
+	for i, mig := range migrations {
+		assert.Equal(t, i+1, mig.version, "migration %s", mig.name)
+		assert.NotEmpty(t, mig.up, "up migration for %d_%s", mig.version, mig.name)
+		assert.NotEmpty(t, mig.down, "down migration for %d_%s", mig.version, mig.name)
+	}
+}
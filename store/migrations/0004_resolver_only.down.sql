@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS ips_resolver_only_uidx;
+DELETE FROM ips WHERE client_ip IS NULL;
+ALTER TABLE ips ALTER COLUMN client_ip SET NOT NULL;
@@ -0,0 +1,4 @@
+-- whoami TXT queries are reported without a client (HTTP) IP
+ALTER TABLE ips ALTER COLUMN client_ip DROP NOT NULL;
+-- with a row for each resolver and ECS net
+CREATE UNIQUE INDEX ips_resolver_only_uidx ON ips (server_ip, edns_net) WHERE client_ip IS NULL;
@@ -0,0 +1,10 @@
+ALTER TABLE ips
+    DROP COLUMN edns_udp_size,
+    DROP COLUMN edns_do,
+    DROP COLUMN edns_nsid,
+    DROP COLUMN edns_cookie,
+    DROP COLUMN rd,
+    DROP COLUMN cd,
+    DROP COLUMN mixed_case,
+    DROP COLUMN server_port,
+    DROP COLUMN transport;
@@ -0,0 +1,10 @@
+ALTER TABLE ips
+    ADD COLUMN edns_udp_size int not null default 0,
+    ADD COLUMN edns_do boolean not null default false,
+    ADD COLUMN edns_nsid boolean not null default false,
+    ADD COLUMN edns_cookie boolean not null default false,
+    ADD COLUMN rd boolean not null default false,
+    ADD COLUMN cd boolean not null default false,
+    ADD COLUMN mixed_case boolean not null default false,
+    ADD COLUMN server_port int not null default 0,
+    ADD COLUMN transport text not null default '';
@@ -0,0 +1,3 @@
+DROP TABLE resolver_latency;
+
+ALTER TABLE ips DROP COLUMN latency_ms;
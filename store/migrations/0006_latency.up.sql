@@ -0,0 +1,11 @@
+ALTER TABLE ips ADD COLUMN latency_ms int null;
+
+-- count of DNS to HTTP latencies per resolver in power of two
+-- buckets; bucket_ms is the upper bound of the bucket
+CREATE TABLE resolver_latency (
+    server_ip inet not null,
+    bucket_ms int not null,
+    count bigint not null default 0,
+    last_seen timestamp with time zone,
+    PRIMARY KEY (server_ip, bucket_ms)
+);
@@ -0,0 +1,3 @@
+-- the client certificate subject or key ID of the node that
+-- submitted the result
+ALTER TABLE ips ADD COLUMN submitter text not null default '';
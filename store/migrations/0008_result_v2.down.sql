@@ -0,0 +1,8 @@
+ALTER TABLE ips DROP COLUMN edns_scope_prefix;
+ALTER TABLE ips DROP COLUMN edns_source_prefix;
+ALTER TABLE ips DROP COLUMN family;
+ALTER TABLE ips DROP COLUMN http_proto;
+ALTER TABLE ips DROP COLUMN http_scheme;
+ALTER TABLE ips DROP COLUMN http_time;
+ALTER TABLE ips DROP COLUMN dns_time;
+ALTER TABLE ips DROP COLUMN node_id;
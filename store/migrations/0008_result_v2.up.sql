@@ -0,0 +1,9 @@
+-- metadata from the v2 result payload
+ALTER TABLE ips ADD COLUMN node_id text not null default '';
+ALTER TABLE ips ADD COLUMN dns_time timestamp with time zone null;
+ALTER TABLE ips ADD COLUMN http_time timestamp with time zone null;
+ALTER TABLE ips ADD COLUMN http_scheme text not null default '';
+ALTER TABLE ips ADD COLUMN http_proto text not null default '';
+ALTER TABLE ips ADD COLUMN family text not null default '';
+ALTER TABLE ips ADD COLUMN edns_source_prefix int not null default 0;
+ALTER TABLE ips ADD COLUMN edns_scope_prefix int not null default 0;
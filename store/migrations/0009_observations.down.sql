@@ -0,0 +1,2 @@
+DROP TABLE observations;
+ALTER TABLE ips DROP COLUMN seen_count;
@@ -0,0 +1,34 @@
+-- how many results were stored for the row (rows from before this
+-- migration were seen at least once)
+ALTER TABLE ips ADD COLUMN seen_count bigint not null default 1;
+
+-- every stored result, partitioned by month. The store creates the
+-- partitions ahead of time and drops them after -historyretention;
+-- results outside of them go to the default partition.
+CREATE TABLE observations (
+    observed_at timestamp with time zone not null,
+    client_ip inet null,
+    server_ip inet not null,
+    edns_net cidr null,
+    client_cc char(2) null,
+    client_rc char(2) null,
+    client_asn int null,
+    server_cc char(2) null,
+    server_rc char(2) null,
+    server_asn int null,
+    edns_cc char(2) null,
+    edns_rc char(2) null,
+    edns_asn int null,
+    has_edns boolean,
+    test_ip inet,
+    latency_ms int null,
+    edns_source_prefix int not null default 0,
+    edns_scope_prefix int not null default 0,
+    family text not null default '',
+    node_id text not null default '',
+    submitter text not null default ''
+) PARTITION BY RANGE (observed_at);
+
+CREATE TABLE observations_default PARTITION OF observations DEFAULT;
+
+CREATE INDEX observations_ip_idx ON observations (server_ip, client_ip, observed_at);
@@ -0,0 +1,34 @@
+ALTER TABLE observations DROP COLUMN geoip_asn_epoch;
+ALTER TABLE observations DROP COLUMN geoip_city_epoch;
+ALTER TABLE observations DROP COLUMN edns_as_org;
+ALTER TABLE observations DROP COLUMN edns_accuracy_radius;
+ALTER TABLE observations DROP COLUMN edns_lon;
+ALTER TABLE observations DROP COLUMN edns_lat;
+ALTER TABLE observations DROP COLUMN edns_city;
+ALTER TABLE observations DROP COLUMN server_as_org;
+ALTER TABLE observations DROP COLUMN server_accuracy_radius;
+ALTER TABLE observations DROP COLUMN server_lon;
+ALTER TABLE observations DROP COLUMN server_lat;
+ALTER TABLE observations DROP COLUMN server_city;
+ALTER TABLE observations DROP COLUMN client_as_org;
+ALTER TABLE observations DROP COLUMN client_accuracy_radius;
+ALTER TABLE observations DROP COLUMN client_lon;
+ALTER TABLE observations DROP COLUMN client_lat;
+ALTER TABLE observations DROP COLUMN client_city;
+ALTER TABLE ips DROP COLUMN geoip_asn_epoch;
+ALTER TABLE ips DROP COLUMN geoip_city_epoch;
+ALTER TABLE ips DROP COLUMN edns_as_org;
+ALTER TABLE ips DROP COLUMN edns_accuracy_radius;
+ALTER TABLE ips DROP COLUMN edns_lon;
+ALTER TABLE ips DROP COLUMN edns_lat;
+ALTER TABLE ips DROP COLUMN edns_city;
+ALTER TABLE ips DROP COLUMN server_as_org;
+ALTER TABLE ips DROP COLUMN server_accuracy_radius;
+ALTER TABLE ips DROP COLUMN server_lon;
+ALTER TABLE ips DROP COLUMN server_lat;
+ALTER TABLE ips DROP COLUMN server_city;
+ALTER TABLE ips DROP COLUMN client_as_org;
+ALTER TABLE ips DROP COLUMN client_accuracy_radius;
+ALTER TABLE ips DROP COLUMN client_lon;
+ALTER TABLE ips DROP COLUMN client_lat;
+ALTER TABLE ips DROP COLUMN client_city;
@@ -0,0 +1,38 @@
+-- city, location and AS organization from the GeoIP databases for the
+-- client, resolver and ECS addresses, and the build time of the
+-- databases they came from
+ALTER TABLE ips ADD COLUMN client_city text not null default '';
+ALTER TABLE ips ADD COLUMN client_lat double precision null;
+ALTER TABLE ips ADD COLUMN client_lon double precision null;
+ALTER TABLE ips ADD COLUMN client_accuracy_radius int not null default 0;
+ALTER TABLE ips ADD COLUMN client_as_org text not null default '';
+ALTER TABLE ips ADD COLUMN server_city text not null default '';
+ALTER TABLE ips ADD COLUMN server_lat double precision null;
+ALTER TABLE ips ADD COLUMN server_lon double precision null;
+ALTER TABLE ips ADD COLUMN server_accuracy_radius int not null default 0;
+ALTER TABLE ips ADD COLUMN server_as_org text not null default '';
+ALTER TABLE ips ADD COLUMN edns_city text not null default '';
+ALTER TABLE ips ADD COLUMN edns_lat double precision null;
+ALTER TABLE ips ADD COLUMN edns_lon double precision null;
+ALTER TABLE ips ADD COLUMN edns_accuracy_radius int not null default 0;
+ALTER TABLE ips ADD COLUMN edns_as_org text not null default '';
+ALTER TABLE ips ADD COLUMN geoip_city_epoch bigint not null default 0;
+ALTER TABLE ips ADD COLUMN geoip_asn_epoch bigint not null default 0;
+
+ALTER TABLE observations ADD COLUMN client_city text not null default '';
+ALTER TABLE observations ADD COLUMN client_lat double precision null;
+ALTER TABLE observations ADD COLUMN client_lon double precision null;
+ALTER TABLE observations ADD COLUMN client_accuracy_radius int not null default 0;
+ALTER TABLE observations ADD COLUMN client_as_org text not null default '';
+ALTER TABLE observations ADD COLUMN server_city text not null default '';
+ALTER TABLE observations ADD COLUMN server_lat double precision null;
+ALTER TABLE observations ADD COLUMN server_lon double precision null;
+ALTER TABLE observations ADD COLUMN server_accuracy_radius int not null default 0;
+ALTER TABLE observations ADD COLUMN server_as_org text not null default '';
+ALTER TABLE observations ADD COLUMN edns_city text not null default '';
+ALTER TABLE observations ADD COLUMN edns_lat double precision null;
+ALTER TABLE observations ADD COLUMN edns_lon double precision null;
+ALTER TABLE observations ADD COLUMN edns_accuracy_radius int not null default 0;
+ALTER TABLE observations ADD COLUMN edns_as_org text not null default '';
+ALTER TABLE observations ADD COLUMN geoip_city_epoch bigint not null default 0;
+ALTER TABLE observations ADD COLUMN geoip_asn_epoch bigint not null default 0;
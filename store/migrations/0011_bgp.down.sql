@@ -0,0 +1,15 @@
+ALTER TABLE observations DROP COLUMN edns_bgp_asn;
+ALTER TABLE observations DROP COLUMN edns_bgp_prefix;
+ALTER TABLE observations DROP COLUMN server_bgp_asn;
+ALTER TABLE observations DROP COLUMN server_bgp_prefix;
+ALTER TABLE observations DROP COLUMN client_bgp_asn;
+ALTER TABLE observations DROP COLUMN client_bgp_prefix;
+
+ALTER TABLE ips DROP COLUMN edns_bgp_asn;
+ALTER TABLE ips DROP COLUMN edns_bgp_prefix;
+ALTER TABLE ips DROP COLUMN server_bgp_asn;
+ALTER TABLE ips DROP COLUMN server_bgp_prefix;
+ALTER TABLE ips DROP COLUMN client_bgp_asn;
+ALTER TABLE ips DROP COLUMN client_bgp_prefix;
+
+DROP TABLE bgp_prefixes;
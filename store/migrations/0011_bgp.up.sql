@@ -0,0 +1,23 @@
+-- announced prefixes and origin ASNs from the APNIC routing table,
+-- replaced by "store bgp-import"
+CREATE TABLE bgp_prefixes (
+    prefix cidr primary key,
+    origin_asn bigint not null,
+    as_name text not null default ''
+);
+
+-- the announced prefix and origin ASN for the client, resolver and ECS
+-- addresses when the result was stored
+ALTER TABLE ips ADD COLUMN client_bgp_prefix cidr null;
+ALTER TABLE ips ADD COLUMN client_bgp_asn bigint not null default 0;
+ALTER TABLE ips ADD COLUMN server_bgp_prefix cidr null;
+ALTER TABLE ips ADD COLUMN server_bgp_asn bigint not null default 0;
+ALTER TABLE ips ADD COLUMN edns_bgp_prefix cidr null;
+ALTER TABLE ips ADD COLUMN edns_bgp_asn bigint not null default 0;
+
+ALTER TABLE observations ADD COLUMN client_bgp_prefix cidr null;
+ALTER TABLE observations ADD COLUMN client_bgp_asn bigint not null default 0;
+ALTER TABLE observations ADD COLUMN server_bgp_prefix cidr null;
+ALTER TABLE observations ADD COLUMN server_bgp_asn bigint not null default 0;
+ALTER TABLE observations ADD COLUMN edns_bgp_prefix cidr null;
+ALTER TABLE observations ADD COLUMN edns_bgp_asn bigint not null default 0;
@@ -0,0 +1,11 @@
+ALTER TABLE observations DROP COLUMN asn_mismatch;
+ALTER TABLE observations DROP COLUMN region_mismatch;
+ALTER TABLE observations DROP COLUMN country_mismatch;
+ALTER TABLE observations DROP COLUMN edns_distance_km;
+ALTER TABLE observations DROP COLUMN resolver_distance_km;
+
+ALTER TABLE ips DROP COLUMN asn_mismatch;
+ALTER TABLE ips DROP COLUMN region_mismatch;
+ALTER TABLE ips DROP COLUMN country_mismatch;
+ALTER TABLE ips DROP COLUMN edns_distance_km;
+ALTER TABLE ips DROP COLUMN resolver_distance_km;
@@ -0,0 +1,14 @@
+-- computed from the GeoIP details when the result is stored: the
+-- distance from the client to the resolver and ECS locations, and if
+-- the client and resolver are in different countries, regions or ASNs
+ALTER TABLE ips ADD COLUMN resolver_distance_km double precision null;
+ALTER TABLE ips ADD COLUMN edns_distance_km double precision null;
+ALTER TABLE ips ADD COLUMN country_mismatch boolean not null default false;
+ALTER TABLE ips ADD COLUMN region_mismatch boolean not null default false;
+ALTER TABLE ips ADD COLUMN asn_mismatch boolean not null default false;
+
+ALTER TABLE observations ADD COLUMN resolver_distance_km double precision null;
+ALTER TABLE observations ADD COLUMN edns_distance_km double precision null;
+ALTER TABLE observations ADD COLUMN country_mismatch boolean not null default false;
+ALTER TABLE observations ADD COLUMN region_mismatch boolean not null default false;
+ALTER TABLE observations ADD COLUMN asn_mismatch boolean not null default false;
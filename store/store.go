@@ -1,73 +1,152 @@
 package main
 
 import (
-	"database/sql"
-	"errors"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ant0ine/go-json-rest/rest"
+	"github.com/devel/dnsmapper/storage"
 	"github.com/devel/dnsmapper/storeapi"
-	_ "github.com/lib/pq"
-	"github.com/oschwald/geoip2-golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	listen    = flag.String("listen", "", "Listen on this ip:port for the HTTP API")
-	geoipPath = flag.String("geoip", "", "Optional directory for geoip database files")
-	dbuser    = flag.String("dbuser", "ask", "Postgres user name")
-	dbpass    = flag.String("dbpass", "", "Postgres password")
-	dbhost    = flag.String("dbhost", "localhost", "Postgres host name")
+	listen     = flag.String("listen", "", "Listen on this ip:port for the HTTP API")
+	geoipPath  = flag.String("geoip", "", "Optional directory for geoip database files")
+	geoipCheck = flag.Duration("geoipcheck", time.Minute, "Reload the geo provider files when they change, checking at this interval (0 to only reload on SIGHUP)")
+	dbSpec     = flag.String("db", "postgres", "Database; 'postgres' or sqlite:<path>")
+	dbuser     = flag.String("dbuser", "ask", "Postgres user name")
+	dbpass     = flag.String("dbpass", "", "Postgres password")
+	dbhost     = flag.String("dbhost", "localhost", "Postgres host name")
+
+	geoProviders = flag.String("geo", "maxmind", "Geo providers, highest precedence first; comma separated maxmind (from -geoip), mmdb:<layout>:<path> and csv:<path>")
+
+	autoMigrate = flag.Bool("auto-migrate", false, "Apply pending database migrations when starting")
+
+	writeQueue = flag.Int("writequeue", 10000, "Maximum results waiting to be written to the database (at least 1000); more are rejected with 503")
+	writeBatch = flag.Int("writebatch", 500, "Maximum results per database write")
+	writeWait  = flag.Duration("writewait", 100*time.Millisecond, "Maximum time to wait for a batch of results to fill up")
+
+	historyRetention = flag.Duration("historyretention", 0, "Remove observations older than this from the history (0 to keep them)")
+
+	authKeysPath = flag.String("authkeys", "", "File with key IDs and secrets for signed submissions; unsigned submissions are rejected when set")
+	authMaxAge   = flag.Duration("authmaxage", 5*time.Minute, "Maximum clock difference for signed submissions")
+
+	tlsCert     = flag.String("tlscert", "", "TLS certificate for serving HTTPS (optional)")
+	tlsKey      = flag.String("tlskey", "", "TLS key for serving HTTPS")
+	tlsClientCA = flag.String("tlsclientca", "", "Require client certificates signed by the CA(s) in this file for the API (optional)")
 )
 
 var (
-	geodb  *geoip2.Reader
-	geoasn *geoip2.Reader
-	db     *sql.DB
+	db         storage.Storage
+	submitKeys *authKeys
 )
 
-func init() {
+func main() {
 	flag.Parse()
 
-	path, _ := os.LookupEnv("GEOIP")
-
-	if len(*geoipPath) > 0 {
-		path = *geoipPath
+	if flag.Arg(0) == "migrate" {
+		if err := migrateCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("migrate: %s", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "far-resolvers" {
+		if err := farResolversCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("far-resolvers: %s", err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bgp-import" {
+		if err := bgpImportCommand(flag.Args()[1:]); err != nil {
+			log.Fatalf("bgp-import: %s", err)
+		}
+		return
+	}
+	if flag.NArg() > 0 {
+		log.Fatalf("Unknown command '%s'", flag.Arg(0))
 	}
 
-	var err error
-
-	dbName := "GeoLite2-City.mmdb"
-	asnDbName := "GeoLite2-ASN.mmdb"
+	// a batch is queued all at once, so the largest one has to fit
+	if *writeQueue < maxBatchSize {
+		log.Fatalf("-writequeue must be at least %d", maxBatchSize)
+	}
 
-	if len(path) > 0 {
-		dbName = filepath.Join(path, dbName)
-		asnDbName = filepath.Join(path, asnDbName)
+	if *autoMigrate && !strings.HasPrefix(*dbSpec, "sqlite:") {
+		mg, err := newMigrator(pgConnString())
+		if err != nil {
+			log.Fatalf("Could not setup migrations: %s", err)
+		}
+		n, err := mg.Up()
+		mg.Close()
+		if err != nil {
+			log.Fatalf("Could not migrate database: %s", err)
+		}
+		log.Printf("Applied %d migrations", n)
 	}
 
-	geodb, err = geoip2.Open(dbName)
-	if err != nil {
-		log.Printf("Could not open City GeoIP database '%s': %s", dbName, err)
-		log.Fatal(err)
+	openGeoIP()
+	if *geoipCheck > 0 {
+		go geo.watch(*geoipCheck)
 	}
-	log.Printf("Opened '%s' (%s)", dbName, geodb.Metadata().DatabaseType)
 
-	geoasn, err = geoip2.Open(asnDbName)
-	if err != nil {
-		log.Printf("Could not open ASN GeoIP database '%s': %s", asnDbName, err)
-		log.Fatal(err)
+	dbConnect()
+	if err := loadBGP(); err != nil {
+		log.Printf("Could not load BGP prefixes: %s", err)
+	}
+	go maintainHistory(time.Hour)
+
+	writer = newDBWriter(db, *writeQueue, *writeBatch, *writeWait)
+
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-terminate
+		log.Printf("store: %s received, writing %d queued results", sig, writer.Len())
+		writer.Close()
+		os.Exit(0)
+	}()
+
+	if len(*authKeysPath) > 0 {
+		var err error
+		submitKeys, err = newAuthKeys(*authKeysPath, *authMaxAge)
+		if err != nil {
+			log.Fatalf("Could not load submission keys: %s", err)
+		}
+	} else {
+		log.Println("No -authkeys configured, accepting unsigned submissions")
 	}
-	log.Printf("Opened '%s' (%s)", asnDbName, geoasn.Metadata().DatabaseType)
 
-}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if submitKeys != nil {
+				if err := submitKeys.load(); err != nil {
+					log.Printf("Could not reload submission keys: %s", err)
+				}
+			}
+			if err := geo.Load(); err != nil {
+				log.Printf("Could not reload GeoIP databases: %s", err)
+			}
+			if err := loadBGP(); err != nil {
+				log.Printf("Could not reload BGP prefixes: %s", err)
+			}
+		}
+	}()
 
-func main() {
 	startHttp(*listen)
 }
 
@@ -80,6 +159,9 @@ func buildMux() *http.ServeMux {
 
 	router, err := rest.MakeRouter(
 		rest.Post("/api/v1/store-result", storeHandler),
+		rest.Post("/api/v1/store-results", storeBatchHandler),
+		rest.Post("/api/v2/store-result", storeV2Handler),
+		rest.Post("/api/v2/store-results", storeBatchV2Handler),
 	)
 	if err != nil {
 		log.Fatalf("Could not configure router: %s", err)
@@ -87,30 +169,98 @@ func buildMux() *http.ServeMux {
 
 	api.SetApp(router)
 
-	mux.Handle("/api/v1/", api.MakeHandler())
+	var apiHandler http.Handler = limitRequestSize(api.MakeHandler())
+	if submitKeys != nil {
+		apiHandler = submitKeys.requireSignature(apiHandler)
+	}
+	if len(*tlsCert) > 0 && len(*tlsClientCA) > 0 {
+		apiHandler = requireClientCert(apiHandler)
+	}
+	mux.Handle("/api/v1/", apiHandler)
+	mux.Handle("/api/v2/", apiHandler)
 
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("ok\n"))
-		return
-	})
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", healthHandler)
 
 	return mux
 
 }
 
+// limitRequestSize limits how much of the request body is read
+func limitRequestSize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.Body = http.MaxBytesReader(w, req.Body, maxRequestSize)
+		h.ServeHTTP(w, req)
+	})
+}
+
+// healthHandler reports the build epoch of the loaded GeoIP databases
+// so it's possible to see that a reload has taken effect
+func healthHandler(w http.ResponseWriter, req *http.Request) {
+	health := struct {
+		Status string
+		GeoIP  map[string]uint
+	}{
+		Status: "ok",
+		GeoIP:  geo.Epochs(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
+
 func startHttp(listen string) {
-	fmt.Printf("Listening on http://%s\n", listen)
-	err := http.ListenAndServe(listen, buildMux())
+	if len(*tlsCert) == 0 {
+		fmt.Printf("Listening on http://%s\n", listen)
+		err := http.ListenAndServe(listen, buildMux())
+		fmt.Printf("Could not listen to %s: %s", listen, err)
+		return
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if len(*tlsClientCA) > 0 {
+		pem, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			log.Fatalf("Could not read client CA: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			log.Fatalf("No certificates found in %s", *tlsClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	srv := &http.Server{
+		Addr:      listen,
+		Handler:   buildMux(),
+		TLSConfig: tlsConfig,
+	}
+
+	fmt.Printf("Listening on https://%s\n", listen)
+	err := srv.ListenAndServeTLS(*tlsCert, *tlsKey)
 	fmt.Printf("Could not listen to %s: %s", listen, err)
 }
 
+// submitter returns the identity of the node submitting the request;
+// the subject of the verified client certificate or the key ID the
+// request was signed with.
+func submitter(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		return req.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	if submitKeys != nil {
+		return req.Header.Get(storeapi.HeaderKeyID)
+	}
+	return ""
+}
+
+// storeHandler takes a v1 result, converting it to v2
 func storeHandler(w rest.ResponseWriter, r *rest.Request) {
 
-	// err := r.ParseForm()
-	// if err != nil {
-	// log.Println("parse error", err)
-	// }
+	timer := prometheus.NewTimer(ingestDuration)
+	defer timer.ObserveDuration()
 
 	now := time.Now().UTC()
 
@@ -121,181 +271,174 @@ func storeHandler(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	data := &storeapi.LogData{
-		TestIP:   reqData.TestIP,
-		ClientIP: reqData.ClientIP,
-		ServerIP: reqData.ServerIP,
-		EdnsNet:  reqData.EdnsNet,
-		LastSeen: &now,
-	}
-
-	data.ClientCC, data.ClientRC, data.ClientASN = ccLookup(net.ParseIP(data.ClientIP))
-	data.ServerCC, data.ServerRC, data.ServerASN = ccLookup(net.ParseIP(data.ServerIP))
-
-	if len(data.EdnsNet) > 0 {
-		ednsIP, _, _ := net.ParseCIDR(data.EdnsNet)
-		data.EdnsCC, data.EdnsRC, data.EdnsASN = ccLookup(net.ParseIP(ednsIP.String()))
-		data.HasEdns = true
-	} else {
-		data.EdnsNet = data.ServerIP
-		data.EdnsCC, data.EdnsRC, data.EdnsASN = data.ServerCC, data.ServerRC, data.ServerASN
-		data.HasEdns = false
-	}
-
-	w.WriteHeader(204)
+	storeResult(w, r, reqData.V2(now), now)
+}
 
-	// w.WriteJson(data)
+func storeV2Handler(w rest.ResponseWriter, r *rest.Request) {
 
-	dbStore(data)
+	timer := prometheus.NewTimer(ingestDuration)
+	defer timer.ObserveDuration()
 
-}
+	now := time.Now().UTC()
 
-func ccLookup(ip net.IP) (rcc string, rrc string, rasn uint) {
-	// rcc: return country code, rrc: return region code, rasn: return asn
-	if ip == nil {
+	result := &storeapi.ResultV2{}
+	err := r.DecodeJsonPayload(&result)
+	if err != nil {
+		rest.Error(w, "Could not decode JSON: "+err.Error(), 400)
 		return
 	}
 
-	// If you are using strings that may be invalid, check that ip is not nil
-	record, err := geodb.City(ip)
+	storeResult(w, r, result, now)
+}
 
-	if err != nil || record.Country.IsoCode == "" {
-		if err == nil {
-			err = errors.New("not found")
-		}
-		log.Printf("Could not lookup data for '%s': %s", ip.String(), err)
-	} else {
-		// fmt.Printf("city name: %v\n", record.City.Names["en"])
-		// if len(record.Subdivisions) > 0 {
-		// 	fmt.Printf("subdivision name: %v\n", record.Subdivisions[0].Names["en"])
-		// }
-		// fmt.Printf("country name: %v\n", record.Country.Names["en"])
-		// fmt.Printf("ISO country code: %v\n", record.Country.IsoCode)
-		// fmt.Printf("Time zone: %v\n", record.Location.TimeZone)
-		// fmt.Printf("Coordinates: %v, %v\n", record.Location.Latitude, record.Location.Longitude)
-
-		rcc = record.Country.IsoCode
-
-		if len(record.Subdivisions) > 0 {
-			rrc = record.Subdivisions[0].IsoCode
-		}
-	}
+// retryAfter is the Retry-After (seconds) when the write queue is full
+const retryAfter = "1"
 
-	asn, err := geoasn.ASN(ip)
+func storeResult(w rest.ResponseWriter, r *rest.Request, result *storeapi.ResultV2, now time.Time) {
+	data, err := logData(result, now)
 	if err != nil {
-		log.Printf("Could not lookup ASN data for '%s': %s", ip.String(), err)
-	} else {
-		rasn = asn.AutonomousSystemNumber
+		rest.Error(w, err.Error(), 400)
+		return
 	}
+	data.Submitter = submitter(r.Request)
 
-	return rcc, rrc, rasn
-}
-
-func dbConnect() {
-	var err error
-	db, err = sql.Open("postgres", fmt.Sprintf("user=%s host=%s password=%s", *dbuser, *dbhost, *dbpass))
-	if err != nil {
-		log.Fatalf("create db error: %s", err)
+	if !writer.Add(data) {
+		w.Header().Set("Retry-After", retryAfter)
+		rest.Error(w, "Too many results queued, try again later", 503)
+		return
 	}
-	db.SetMaxOpenConns(50)
+
+	w.WriteHeader(204)
 }
 
-func dbStore(data *storeapi.LogData) error {
+// logData validates the submitted result and adds the geoip data.
+// The result is stored as last seen when the node saw it, unless
+// that's missing or in the future.
+func logData(result *storeapi.ResultV2, now time.Time) (*storeapi.LogData, error) {
 
-	if db == nil {
-		dbConnect()
+	if net.ParseIP(result.ServerIP) == nil {
+		return nil, fmt.Errorf("invalid ServerIP '%s'", result.ServerIP)
+	}
+	if len(result.ClientIP) > 0 && net.ParseIP(result.ClientIP) == nil {
+		return nil, fmt.Errorf("invalid ClientIP '%s'", result.ClientIP)
 	}
 
-	fmt.Printf("dbStore: %#v\n", data)
-
-	rv, err := db.Exec(`
-	WITH upsert_data AS (
-		SELECT
-		$1::inet AS client_ip,
-		$2::inet AS server_ip,
-		$3::cidr AS edns_net,
+	seen := result.DNSTime
+	if result.HTTPTime != nil {
+		seen = *result.HTTPTime
+	}
+	if seen.IsZero() || seen.After(now) {
+		seen = now
+	}
+	seen = seen.UTC()
 
-		$4::char(2) AS client_cc,
-		$5::char(2) AS client_rc,
-		$6::int AS client_asn,
+	data := &storeapi.LogData{
+		TestIP:   result.TestIP,
+		ClientIP: result.ClientIP,
+		ServerIP: result.ServerIP,
+		EdnsNet:  result.EdnsNet,
+		LastSeen: &seen,
+
+		NodeID:           result.NodeID,
+		HTTPScheme:       result.HTTPScheme,
+		HTTPProto:        result.HTTPProto,
+		Family:           result.Family,
+		EdnsSourcePrefix: result.EdnsSourcePrefix,
+		EdnsScopePrefix:  result.EdnsScopePrefix,
+
+		ResolverFingerprint: result.ResolverFingerprint,
+	}
 
-		$7::char(2) AS server_cc,
-		$8::char(2) AS server_rc,
-		$9::int AS     server_asn,
+	if !result.DNSTime.IsZero() {
+		dnsTime := result.DNSTime.UTC()
+		data.DNSTime = &dnsTime
+	}
+	if result.HTTPTime != nil {
+		httpTime := result.HTTPTime.UTC()
+		data.HTTPTime = &httpTime
+	}
 
-		$10::char(2) AS edns_cc,
-		$11::char(2) AS edns_rc,
-		$12::int AS     edns_asn,
+	if len(data.Family) == 0 {
+		if len(data.ClientIP) > 0 {
+			data.Family = storeapi.AddressFamily(data.ClientIP)
+		} else {
+			data.Family = storeapi.AddressFamily(data.ServerIP)
+		}
+	}
 
-		$13::inet AS test_ip,
+	// resolver-only (whoami) results don't have an HTTP request
+	if len(data.ClientIP) > 0 {
+		if latency := result.LatencyMS(); latency >= 0 {
+			data.LatencyMS = &latency
+		}
+	}
 
-		$14::boolean AS has_edns,
-		$15::timestamp AS last_seen
-	),
-	update_ips AS (
-		UPDATE ips
-		SET
-			edns_net = ud.edns_net,
+	client := geo.Lookup(net.ParseIP(data.ClientIP))
+	data.ClientCC, data.ClientRC, data.ClientASN = client.CC, client.RC, client.ASN
+	data.ClientCity, data.ClientLat, data.ClientLon = client.City, client.Lat, client.Lon
+	data.ClientAccuracyRadius, data.ClientASOrg = client.AccuracyRadius, client.ASOrg
+	data.ClientBGPPrefix, data.ClientBGPASN = bgpLookup(net.ParseIP(data.ClientIP))
 
-			client_cc = ud.client_cc,
-			client_rc = ud.client_rc,
-			client_asn = ud.client_asn,
+	server := geo.Lookup(net.ParseIP(data.ServerIP))
+	data.ServerCC, data.ServerRC, data.ServerASN = server.CC, server.RC, server.ASN
+	data.ServerCity, data.ServerLat, data.ServerLon = server.City, server.Lat, server.Lon
+	data.ServerAccuracyRadius, data.ServerASOrg = server.AccuracyRadius, server.ASOrg
+	data.ServerBGPPrefix, data.ServerBGPASN = bgpLookup(net.ParseIP(data.ServerIP))
 
-			server_cc = ud.server_cc,
-			server_rc = ud.server_rc,
-			server_asn = ud.server_asn,
+	edns := server
+	data.EdnsBGPPrefix, data.EdnsBGPASN = data.ServerBGPPrefix, data.ServerBGPASN
+	if len(data.EdnsNet) > 0 {
+		ednsIP, _, err := net.ParseCIDR(data.EdnsNet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EdnsNet '%s'", data.EdnsNet)
+		}
+		edns = geo.Lookup(ednsIP)
+		data.EdnsBGPPrefix, data.EdnsBGPASN = bgpLookup(ednsIP)
+		data.HasEdns = true
+	} else {
+		data.EdnsNet = data.ServerIP
+		data.HasEdns = false
+	}
+	data.EdnsCC, data.EdnsRC, data.EdnsASN = edns.CC, edns.RC, edns.ASN
+	data.EdnsCity, data.EdnsLat, data.EdnsLon = edns.City, edns.Lat, edns.Lon
+	data.EdnsAccuracyRadius, data.EdnsASOrg = edns.AccuracyRadius, edns.ASOrg
 
-			edns_cc = ud.edns_cc,
-			edns_rc = ud.edns_rc,
-			edns_asn = ud.edns_asn,
+	compareLocations(data)
 
-			test_ip = ud.test_ip,
+	// the data could be reloaded between lookups; record the first
+	// epochs found
+	for _, info := range []GeoInfo{client, server, edns} {
+		if data.GeoIPCityEpoch == 0 {
+			data.GeoIPCityEpoch = info.LocationEpoch
+		}
+		if data.GeoIPASNEpoch == 0 {
+			data.GeoIPASNEpoch = info.ASNEpoch
+		}
+	}
 
-			has_edns = ud.has_edns,
-			last_seen = ud.last_seen
+	return data, nil
+}
 
-		FROM upsert_data ud
-		WHERE
-			ips.client_ip = ud.client_ip AND
-			ips.server_ip = ud.server_ip
-		RETURNING ips.*
-	)
-	INSERT INTO
-		ips
-		(client_ip, server_ip, edns_net,
-		 client_cc, client_rc, client_asn,
-		 server_cc, server_rc, server_asn,
-		 edns_cc, edns_rc, edns_asn,
-		 test_ip, has_edns,
-		 first_seen, last_seen
-		)
-		SELECT
-			client_ip, server_ip, edns_net,
-			client_cc, client_rc, client_asn,
-			server_cc, server_rc, server_asn,
-			edns_cc, edns_rc, edns_asn,
-			test_ip, has_edns,
-			last_seen, last_seen
-			FROM upsert_data
-			WHERE NOT EXISTS (
-				SELECT 1 FROM update_ips up
-				WHERE (up.client_ip = upsert_data.client_ip)
-			)
-	`,
-		data.ClientIP, data.ServerIP, data.EdnsNet,
-		data.ClientCC, data.ClientRC, data.ClientASN,
-		data.ServerCC, data.ServerRC, data.ServerASN,
-		data.EdnsCC, data.EdnsRC, data.EdnsASN,
-		data.TestIP, data.HasEdns, data.LastSeen,
-	)
+func pgConnString() string {
+	return fmt.Sprintf("user=%s host=%s password=%s", *dbuser, *dbhost, *dbpass)
+}
 
+func dbConnect() {
+	var err error
+	db, err = storage.OpenSpec(*dbSpec, pgConnString())
 	if err != nil {
-		fmt.Printf("DB Error: %s\n", err)
-		return err
+		log.Fatalf("create db error: %s", err)
 	}
+}
 
-	updated, _ := rv.RowsAffected()
-	fmt.Printf("Updated %d rows\n", updated)
-
-	return err
+// maintainHistory runs the history maintenance (new partitions and
+// retention) now and then at each interval
+func maintainHistory(interval time.Duration) {
+	for {
+		if err := db.MaintainHistory(time.Now(), *historyRetention); err != nil {
+			dbErrors.Inc()
+			log.Printf("Could not maintain observations history: %s", err)
+		}
+		time.Sleep(interval)
+	}
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/devel/dnsmapper/storage"
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// writer stores the accepted results
+var writer *dbWriter
+
+// dbWriter stores results from a bounded queue. One goroutine takes
+// them off the queue in batches (up to batchSize, waiting at most
+// wait for a batch to fill up) so the database gets a few large
+// writes instead of an upsert per request.
+type dbWriter struct {
+	st        storage.Storage
+	batchSize int
+	wait      time.Duration
+
+	// mu makes Add all or nothing for a batch of results
+	mu     sync.Mutex
+	closed bool
+	queue  chan *storeapi.LogData
+	done   chan struct{}
+}
+
+func newDBWriter(st storage.Storage, queueSize, batchSize int, wait time.Duration) *dbWriter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	w := &dbWriter{
+		st:        st,
+		batchSize: batchSize,
+		wait:      wait,
+		queue:     make(chan *storeapi.LogData, queueSize),
+		done:      make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Add queues the results for writing. It returns false (and queues
+// none of them) if there isn't room for all of them.
+func (w *dbWriter) Add(results ...*storeapi.LogData) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed || cap(w.queue)-len(w.queue) < len(results) {
+		writeRejected.Add(float64(len(results)))
+		return false
+	}
+	// only Add sends to the queue, so this doesn't block
+	for _, data := range results {
+		w.queue <- data
+	}
+	return true
+}
+
+// Len is the number of results waiting to be written
+func (w *dbWriter) Len() int {
+	return len(w.queue)
+}
+
+// Close stops accepting results and waits for the queue to be
+// written.
+func (w *dbWriter) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+func (w *dbWriter) run() {
+	defer close(w.done)
+
+	batch := make([]*storeapi.LogData, 0, w.batchSize)
+
+	for data := range w.queue {
+		batch = append(batch, data)
+
+		timeout := time.NewTimer(w.wait)
+	fill:
+		for len(batch) < w.batchSize {
+			select {
+			case data, ok := <-w.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, data)
+			case <-timeout.C:
+				break fill
+			}
+		}
+		timeout.Stop()
+
+		w.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// write stores the batch together; if that fails the results are
+// stored one at a time so one bad result doesn't lose the others.
+func (w *dbWriter) write(batch []*storeapi.LogData) {
+	timer := prometheus.NewTimer(writeDuration)
+	defer timer.ObserveDuration()
+	writeBatchSize.Observe(float64(len(batch)))
+
+	err := w.st.StoreMany(batch)
+	if err == nil {
+		return
+	}
+	log.Printf("Could not store batch of %d results, retrying one by one: %s", len(batch), err)
+
+	errs, err := w.st.StoreBatch(batch)
+	if err != nil {
+		dbErrors.Add(float64(len(batch)))
+		log.Printf("Could not store batch of %d results: %s", len(batch), err)
+		return
+	}
+	for i, err := range errs {
+		if err != nil {
+			dbErrors.Inc()
+			log.Printf("Could not store %+v: %s", batch[i], err)
+		}
+	}
+}
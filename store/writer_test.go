@@ -0,0 +1,90 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devel/dnsmapper/storage"
+	"github.com/devel/dnsmapper/storeapi"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingStorage records the batches written; writes wait for
+// release to be closed.
+type blockingStorage struct {
+	writing chan struct{}
+	release chan struct{}
+
+	mu      sync.Mutex
+	batches [][]*storeapi.LogData
+}
+
+func (s *blockingStorage) Store(data *storeapi.LogData) error { return nil }
+
+func (s *blockingStorage) StoreBatch(batch []*storeapi.LogData) ([]error, error) {
+	return make([]error, len(batch)), nil
+}
+
+func (s *blockingStorage) StoreMany(batch []*storeapi.LogData) error {
+	select {
+	case s.writing <- struct{}{}:
+	default:
+	}
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, append([]*storeapi.LogData{}, batch...))
+	return nil
+}
+
+func (s *blockingStorage) ClientResults(clientIP string) ([]storeapi.LogData, error) {
+	return nil, nil
+}
+
+func (s *blockingStorage) MaintainHistory(now time.Time, retention time.Duration) error {
+	return nil
+}
+
+func (s *blockingStorage) FarResolvers(since time.Time, farKM float64, minObservations, limit int) ([]storage.ResolverDistance, error) {
+	return nil, nil
+}
+
+func (s *blockingStorage) ReplaceBGPPrefixes(prefixes []storage.BGPPrefix) error { return nil }
+
+func (s *blockingStorage) BGPPrefixes() ([]storage.BGPPrefix, error) { return nil, nil }
+
+func (s *blockingStorage) Ping() error  { return nil }
+func (s *blockingStorage) Close() error { return nil }
+
+func TestDBWriter(t *testing.T) {
+	st := &blockingStorage{writing: make(chan struct{}, 1), release: make(chan struct{})}
+	w := newDBWriter(st, 4, 3, time.Millisecond)
+
+	result := func() *storeapi.LogData {
+		return &storeapi.LogData{ServerIP: "192.0.2.53"}
+	}
+
+	// the writer takes the first result and then waits for the
+	// storage with a batch of one
+	assert.True(t, w.Add(result()))
+	<-st.writing
+
+	assert.True(t, w.Add(result(), result(), result()))
+	assert.False(t, w.Add(result(), result()), "not room for both")
+	assert.Equal(t, 3, w.Len())
+	assert.True(t, w.Add(result()))
+	assert.False(t, w.Add(result()), "queue full")
+
+	close(st.release)
+	w.Close()
+
+	assert.False(t, w.Add(result()), "closed")
+
+	n := 0
+	for _, batch := range st.batches {
+		assert.LessOrEqual(t, len(batch), 3)
+		n += len(batch)
+	}
+	assert.Equal(t, 5, n)
+}
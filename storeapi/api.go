@@ -5,11 +5,28 @@ import (
 	"time"
 )
 
+// ResolverFingerprint holds passive traits of the DNS query the
+// resolver sent us, used to group resolver software and behaviour.
+type ResolverFingerprint struct {
+	EdnsUDPSize uint16 `db:"edns_udp_size"`
+	EdnsDO      bool   `db:"edns_do"`
+	EdnsNSID    bool   `db:"edns_nsid"`
+	EdnsCookie  bool   `db:"edns_cookie"`
+	RD          bool   `db:"rd"`
+	CD          bool   `db:"cd"`
+	MixedCase   bool   `db:"mixed_case"`
+	ServerPort  uint16 `db:"server_port"`
+	Transport   string `db:"transport"`
+}
+
 type RequestData struct {
 	ClientIP string
 	ServerIP string
 	EdnsNet  string
 	TestIP   string
+	// LatencyMS is the time from the DNS query to the HTTP request
+	LatencyMS int64
+	ResolverFingerprint
 }
 
 type LogData struct {
@@ -29,6 +46,80 @@ type LogData struct {
 	TestIP    string     `db:"test_ip" json:"-"`
 	FirstSeen *time.Time `db:"first_seen" json:"-"`
 	LastSeen  *time.Time `db:"last_seen" json:"-"`
+	LatencyMS *int64     `db:"latency_ms"`
+	Submitter string     `db:"submitter" json:"-"`
+
+	NodeID           string     `db:"node_id" json:"-"`
+	DNSTime          *time.Time `db:"dns_time" json:"-"`
+	HTTPTime         *time.Time `db:"http_time" json:"-"`
+	HTTPScheme       string     `db:"http_scheme"`
+	HTTPProto        string     `db:"http_proto"`
+	Family           string     `db:"family"`
+	EdnsSourcePrefix int        `db:"edns_source_prefix"`
+	EdnsScopePrefix  int        `db:"edns_scope_prefix"`
+
+	// SeenCount is how many results were stored for the client and
+	// server IP
+	SeenCount int64 `db:"seen_count"`
+
+	// Location and AS details from GeoIP; the coordinates are nil when
+	// the database doesn't have a location for the address and the
+	// accuracy radius is in kilometers.
+	ClientCity           string   `db:"client_city"`
+	ClientLat            *float64 `db:"client_lat"`
+	ClientLon            *float64 `db:"client_lon"`
+	ClientAccuracyRadius uint16   `db:"client_accuracy_radius"`
+	ClientASOrg          string   `db:"client_as_org"`
+	ServerCity           string   `db:"server_city"`
+	ServerLat            *float64 `db:"server_lat"`
+	ServerLon            *float64 `db:"server_lon"`
+	ServerAccuracyRadius uint16   `db:"server_accuracy_radius"`
+	ServerASOrg          string   `db:"server_as_org"`
+	EdnsCity             string   `db:"edns_city"`
+	EdnsLat              *float64 `db:"edns_lat"`
+	EdnsLon              *float64 `db:"edns_lon"`
+	EdnsAccuracyRadius   uint16   `db:"edns_accuracy_radius"`
+	EdnsASOrg            string   `db:"edns_as_org"`
+
+	// GeoIPCityEpoch and GeoIPASNEpoch are the build times (seconds
+	// since the epoch) of the databases the details came from
+	GeoIPCityEpoch uint `db:"geoip_city_epoch"`
+	GeoIPASNEpoch  uint `db:"geoip_asn_epoch"`
+
+	// The announced BGP prefixes the addresses are in and their origin
+	// ASNs; nil and 0 when no imported prefix has the address.
+	ClientBGPPrefix *string `db:"client_bgp_prefix"`
+	ClientBGPASN    uint    `db:"client_bgp_asn"`
+	ServerBGPPrefix *string `db:"server_bgp_prefix"`
+	ServerBGPASN    uint    `db:"server_bgp_asn"`
+	EdnsBGPPrefix   *string `db:"edns_bgp_prefix"`
+	EdnsBGPASN      uint    `db:"edns_bgp_asn"`
+
+	// ResolverDistanceKM and EdnsDistanceKM are the great-circle
+	// distances from the client location to the resolver and ECS
+	// locations; nil if either location isn't known.
+	ResolverDistanceKM *float64 `db:"resolver_distance_km"`
+	EdnsDistanceKM     *float64 `db:"edns_distance_km"`
+
+	// The client and the resolver are in different countries, regions
+	// or ASNs; false if either isn't known.
+	CountryMismatch bool `db:"country_mismatch"`
+	RegionMismatch  bool `db:"region_mismatch"`
+	ASNMismatch     bool `db:"asn_mismatch"`
+
+	ResolverFingerprint
+}
+
+// BatchResult is the response from the batch store-results API
+type BatchResult struct {
+	Stored int
+	Errors []BatchError `json:",omitempty"`
+}
+
+// BatchError is the error for one item in a batch
+type BatchError struct {
+	Index int
+	Error string
 }
 
 func (data *RequestData) JSON() ([]byte, error) {
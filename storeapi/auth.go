@@ -0,0 +1,67 @@
+package storeapi
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers for signed requests to the store
+const (
+	HeaderKeyID     = "X-Dnsmapper-Key"
+	HeaderTimestamp = "X-Dnsmapper-Timestamp"
+	HeaderNonce     = "X-Dnsmapper-Nonce"
+	HeaderSignature = "X-Dnsmapper-Signature"
+)
+
+// Signature returns the hex encoded HMAC-SHA256 of the request
+func Signature(secret []byte, method, path, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + " " + path + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest adds the key ID, a timestamp, a nonce and the signature
+// for them and the body to the request headers.
+func SignRequest(req *http.Request, body []byte, keyID string, secret []byte) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	nonce := hex.EncodeToString(buf)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(HeaderKeyID, keyID)
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderNonce, nonce)
+	req.Header.Set(HeaderSignature, Signature(secret, req.Method, req.URL.Path, ts, nonce, body))
+
+	return nil
+}
+
+// CheckSignature verifies the signature on the request with the
+// secret. Checking the timestamp and that the nonce wasn't used
+// before is up to the caller.
+func CheckSignature(req *http.Request, body []byte, secret []byte) error {
+	sig, err := hex.DecodeString(req.Header.Get(HeaderSignature))
+	if err != nil || len(sig) == 0 {
+		return errors.New("missing or invalid signature")
+	}
+
+	expected, _ := hex.DecodeString(Signature(secret,
+		req.Method, req.URL.Path,
+		req.Header.Get(HeaderTimestamp), req.Header.Get(HeaderNonce),
+		body,
+	))
+
+	if !hmac.Equal(sig, expected) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
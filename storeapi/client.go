@@ -0,0 +1,187 @@
+package storeapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxErrorBody limits how much of an error response is kept in the
+// StatusError
+const maxErrorBody = 512
+
+// StatusError is returned by the Client when the server responds with
+// a 4xx or 5xx status.
+type StatusError struct {
+	StatusCode int
+	// Message is the (start of the) response body
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if len(e.Message) == 0 {
+		return fmt.Sprintf("unexpected response %d", e.StatusCode)
+	}
+	return fmt.Sprintf("unexpected response %d: %s", e.StatusCode, e.Message)
+}
+
+// ClientError is true for 4xx responses; retrying the same request
+// isn't likely to help.
+func (e *StatusError) ClientError() bool {
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// Temporary is true for 5xx responses and rate limiting, where it
+// makes sense to try again later.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Client talks to the store (submitting results) and mist (looking
+// up results) APIs. The zero value isn't usable; use NewClient.
+type Client struct {
+	// BaseURL is the scheme and host of the server, for example
+	// https://store.example.com:8080
+	BaseURL string
+
+	// HTTPClient is used for the requests; configure its transport
+	// for TLS client certificates and timeouts.
+	HTTPClient *http.Client
+
+	// KeyID and Secret sign submissions when Secret is set
+	KeyID  string
+	Secret []byte
+}
+
+// NewClient returns a client for the server at baseURL using
+// http.DefaultClient.
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: http.DefaultClient,
+	}
+}
+
+func (c *Client) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if method == "POST" && len(c.Secret) > 0 {
+		if err := SignRequest(req, body, c.KeyID, c.Secret); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// do sends the request and decodes a JSON response into v (unless
+// v is nil). Responses outside 2xx are returned as a *StatusError.
+func (c *Client) do(req *http.Request, v interface{}) error {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		buf, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(buf)),
+		}
+	}
+
+	if v == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("could not decode response: %s", err)
+	}
+	return nil
+}
+
+// StoreResult submits one result to the store
+func (c *Client) StoreResult(ctx context.Context, data *ResultV2) error {
+	js, err := data.JSON()
+	if err != nil {
+		return err
+	}
+
+	req, err := c.newRequest(ctx, "POST", "/api/v2/store-result", js)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.do(req, nil)
+}
+
+// StoreResults submits a batch of results to the store as gzip
+// compressed NDJSON. Results the store couldn't save are listed in
+// the Errors of the BatchResult.
+func (c *Client) StoreResults(ctx context.Context, batch []*ResultV2) (*BatchResult, error) {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	enc := json.NewEncoder(gz)
+	for _, data := range batch {
+		if err := enc.Encode(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := c.newRequest(ctx, "POST", "/api/v2/store-results", buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	result := &BatchResult{}
+	if err := c.do(req, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Health returns an error unless the server's /healthz check is ok
+func (c *Client) Health(ctx context.Context) error {
+	req, err := c.newRequest(ctx, "GET", "/healthz", nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+// MyIP returns what mist knows about the resolvers used by the
+// client's IP (as seen by mist), most recently seen first.
+func (c *Client) MyIP(ctx context.Context) ([]LogData, error) {
+	req, err := c.newRequest(ctx, "GET", "/api/v1/myip", nil)
+	if err != nil {
+		return nil, err
+	}
+	ips := []LogData{}
+	if err := c.do(req, &ips); err != nil {
+		return nil, err
+	}
+	return ips, nil
+}
@@ -0,0 +1,83 @@
+package storeapi
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/api/v2/store-result":
+			body, _ := io.ReadAll(req.Body)
+			if err := CheckSignature(req, body, []byte("secret")); err != nil {
+				http.Error(w, err.Error(), 401)
+				return
+			}
+			w.WriteHeader(204)
+		case "/api/v2/store-results":
+			gz, err := gzip.NewReader(req.Body)
+			if !assert.NoError(t, err) {
+				return
+			}
+			dec := json.NewDecoder(gz)
+			n := 0
+			for dec.More() {
+				data := ResultV2{}
+				assert.NoError(t, dec.Decode(&data))
+				n++
+			}
+			json.NewEncoder(w).Encode(BatchResult{Stored: n - 1, Errors: []BatchError{{Index: 0, Error: "invalid"}}})
+		case "/api/v1/myip":
+			json.NewEncoder(w).Encode([]LogData{{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}})
+		case "/healthz":
+			http.Error(w, "db unavailable", 503)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := NewClient(srv.URL + "/")
+
+	data := &ResultV2{ClientIP: "192.0.2.1", ServerIP: "198.51.100.1"}
+
+	err := c.StoreResult(ctx, data)
+	statusErr := &StatusError{}
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, 401, statusErr.StatusCode)
+		assert.True(t, statusErr.ClientError())
+		assert.False(t, statusErr.Temporary())
+	}
+
+	c.KeyID = "node1"
+	c.Secret = []byte("secret")
+	assert.NoError(t, c.StoreResult(ctx, data))
+
+	result, err := c.StoreResults(ctx, []*ResultV2{data, data, data})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, result.Stored)
+		assert.Len(t, result.Errors, 1)
+	}
+
+	ips, err := c.MyIP(ctx)
+	if assert.NoError(t, err) && assert.Len(t, ips, 1) {
+		assert.Equal(t, "198.51.100.1", ips[0].ServerIP)
+	}
+
+	err = c.Health(ctx)
+	if assert.True(t, errors.As(err, &statusErr)) {
+		assert.Equal(t, 503, statusErr.StatusCode)
+		assert.Equal(t, "db unavailable", statusErr.Message)
+		assert.True(t, statusErr.Temporary())
+	}
+}
@@ -0,0 +1,105 @@
+package storeapi
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Address families for ResultV2.Family
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// ResultV2 is the v2 result payload (for /api/v2/). It has when the
+// DNS and HTTP requests were seen by the node, so results that are
+// delayed or replayed are stored with the right time.
+type ResultV2 struct {
+	// NodeID is the dnsmapper node reporting the result
+	NodeID string
+
+	ClientIP string
+	ServerIP string
+	EdnsNet  string
+	TestIP   string
+
+	// EdnsSourcePrefix is the source prefix length of the EDNS
+	// client subnet; EdnsScopePrefix the scope prefix length we
+	// answered with.
+	EdnsSourcePrefix int
+	EdnsScopePrefix  int
+
+	// DNSTime is when the resolver's DNS query was seen; HTTPTime
+	// when the client's HTTP request was (not set for resolver-only
+	// results).
+	DNSTime  time.Time
+	HTTPTime *time.Time `json:",omitempty"`
+
+	// HTTPScheme ("http" or "https") and HTTPProto ("HTTP/1.1",
+	// "HTTP/2.0", ...) of the client's request
+	HTTPScheme string `json:",omitempty"`
+	HTTPProto  string `json:",omitempty"`
+
+	// Family is the address family of the client's HTTP request,
+	// or of the DNS query for resolver-only results
+	Family string
+
+	ResolverFingerprint
+}
+
+func (data *ResultV2) JSON() ([]byte, error) {
+	return json.Marshal(data)
+}
+
+// LatencyMS is the time from the DNS query to the HTTP request, or
+// -1 for resolver-only results.
+func (data *ResultV2) LatencyMS() int64 {
+	if data.HTTPTime == nil || data.DNSTime.IsZero() {
+		return -1
+	}
+	return data.HTTPTime.Sub(data.DNSTime).Milliseconds()
+}
+
+// AddressFamily returns FamilyIPv4 or FamilyIPv6 for the IP, or ""
+// if it isn't valid.
+func AddressFamily(ip string) string {
+	nip := net.ParseIP(ip)
+	switch {
+	case nip == nil:
+		return ""
+	case nip.To4() != nil:
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// V2 converts a v1 result that was received at the given time. The
+// v1 payload doesn't have timestamps, so the HTTP request is assumed
+// to have been just before it was received.
+func (data *RequestData) V2(received time.Time) *ResultV2 {
+	r := &ResultV2{
+		ClientIP: data.ClientIP,
+		ServerIP: data.ServerIP,
+		EdnsNet:  data.EdnsNet,
+		TestIP:   data.TestIP,
+		DNSTime:  received,
+
+		ResolverFingerprint: data.ResolverFingerprint,
+	}
+
+	if _, ipnet, err := net.ParseCIDR(data.EdnsNet); err == nil {
+		r.EdnsSourcePrefix, _ = ipnet.Mask.Size()
+	}
+
+	if len(data.ClientIP) > 0 {
+		httpTime := received
+		r.HTTPTime = &httpTime
+		r.DNSTime = received.Add(-time.Duration(data.LatencyMS) * time.Millisecond)
+		r.Family = AddressFamily(data.ClientIP)
+	} else {
+		r.Family = AddressFamily(data.ServerIP)
+	}
+
+	return r
+}
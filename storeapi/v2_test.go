@@ -0,0 +1,33 @@
+package storeapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestDataV2(t *testing.T) {
+	received := time.Date(2023, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	data := &RequestData{
+		ClientIP:  "2001:db8::1",
+		ServerIP:  "192.0.2.53",
+		EdnsNet:   "198.51.100.0/24",
+		LatencyMS: 300,
+	}
+	r := data.V2(received)
+	assert.Equal(t, received, *r.HTTPTime)
+	assert.Equal(t, received.Add(-300*time.Millisecond), r.DNSTime)
+	assert.Equal(t, int64(300), r.LatencyMS())
+	assert.Equal(t, 24, r.EdnsSourcePrefix)
+	assert.Equal(t, FamilyIPv6, r.Family)
+
+	// resolver-only
+	data = &RequestData{ServerIP: "192.0.2.53"}
+	r = data.V2(received)
+	assert.Nil(t, r.HTTPTime)
+	assert.Equal(t, received, r.DNSTime)
+	assert.Equal(t, int64(-1), r.LatencyMS())
+	assert.Equal(t, FamilyIPv4, r.Family)
+}